@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//APIKey grants a client read access to private resource types
+type APIKey struct {
+	//Name says who the key was issued to
+	Name string `json:"name"`
+	//Types lists the private resource types the key can read, * for all of them
+	Types   []string  `json:"types"`
+	Created time.Time `json:"created"`
+	//Revoked is when the key was revoked, zero while it is valid
+	Revoked time.Time `json:"revoked,omitempty"`
+	//ID is the SHA256 of the key, the key itself is only shown when it is issued
+	ID string `json:"id" datastore:"-"`
+}
+
+//allows reports whether the key is valid and grants access to restype
+//types are compared the same way as in the config
+func (k *APIKey) allows(restype string) bool {
+	return k.Revoked.IsZero() && (typeIn(k.Types, restype) || typeIn(k.Types, "*"))
+}
+
+//hashKey returns the ID of an API key
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+//canRead reports whether the request may read resources of restype
+//public types are open to all, private ones need an API key allowing them
+//in the X-Api-Key header or the api_key parameter for clients like EventSource that can not set headers
+func canRead(r *http.Request, restype string) (bool, error) {
+	if !isPrivate(restype) {
+		return true, nil
+	}
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	if key == "" {
+		return false, nil
+	}
+	k, err := keyStore.GetKey(r.Context(), hashKey(key))
+	if err == errNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return k.allows(restype), nil
+}
+
+//authorizeType writes an error response and returns false when the request may not read restype
+func authorizeType(w http.ResponseWriter, r *http.Request, restype string) bool {
+	ok, err := canRead(r, restype)
+	if err != nil {
+		log.Printf("Failed to check API key %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Not Authorized", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+//IssuedKey is the response to issuing a key, the only time Key is shown
+type IssuedKey struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+//keysView manages API keys
+//GET /admin/keys lists them, POST /admin/keys?name=&types= issues one
+//and DELETE /admin/keys/{id} revokes one
+func keysView(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := getURLPart("/admin/keys/", r.URL.Path, 0)
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		keys, err := keyStore.Keys(ctx)
+		if err != nil {
+			log.Printf("Failed to list API keys %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if keys == nil {
+			keys = []*APIKey{}
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	case r.Method == http.MethodPost && id == "":
+		name := r.URL.Query().Get("name")
+		var types []string
+		for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+		if name == "" || len(types) == 0 {
+			http.Error(w, "missing name or types", http.StatusBadRequest)
+			return
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		key := base64.RawURLEncoding.EncodeToString(secret)
+		k := &APIKey{Name: name, Types: types, Created: time.Now().UTC(), ID: hashKey(key)}
+		if err := keyStore.PutKey(ctx, k); err != nil {
+			log.Printf("Failed to store API key %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("issued API key %s to %s for %v", k.ID, k.Name, k.Types)
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(IssuedKey{k, key})
+	case r.Method == http.MethodDelete && id != "":
+		k, err := keyStore.GetKey(ctx, id)
+		if err == errNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if k.Revoked.IsZero() {
+			k.Revoked = time.Now().UTC()
+			if err := keyStore.PutKey(ctx, k); err != nil {
+				log.Printf("Failed to revoke API key %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("revoked API key %s of %s", k.ID, k.Name)
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(k)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+//Archive is the cold storage purged snapshots are written to
+//files are gzipped JSON Lines named {type}/{day}.jsonl.gz
+type Archive interface {
+	//Append adds data which is a complete gzip member to the file name creating it when needed
+	Append(ctx context.Context, name string, data []byte) error
+	//Open returns the content of the file name
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+//archive is where purge keeps expired snapshots, nil when they are just deleted
+var archive Archive
+
+//openArchive returns the archive in cfg.ArchiveDir, nil when archiving is off
+//the directory has to be writable and stay so, which rules out App Engine where only /tmp can be written
+func openArchive() (Archive, error) {
+	if cfg.ArchiveDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.ArchiveDir, 0700); err != nil {
+		return nil, fmt.Errorf("archiving needs a writable ArchiveDir: %v", err)
+	}
+	probe, err := ioutil.TempFile(cfg.ArchiveDir, ".probe")
+	if err != nil {
+		return nil, fmt.Errorf("archiving needs a writable ArchiveDir: %v", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return dirArchive(cfg.ArchiveDir), nil
+}
+
+//dirArchive keeps archive files in a local directory
+type dirArchive string
+
+//validArchiveName refuses names that are not a plain relative path like tours/2019-01-31.jsonl.gz
+func validArchiveName(name string) error {
+	if name == "" || path.Clean(name) != name || path.IsAbs(name) ||
+		strings.HasPrefix(name, "..") || strings.Contains(name, `\`) {
+		return fmt.Errorf("invalid archive name %q", name)
+	}
+	return nil
+}
+
+//path returns the file path of name
+func (d dirArchive) path(name string) (string, error) {
+	if err := validArchiveName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(string(d), filepath.FromSlash(name)), nil
+}
+
+//Append implements Archive
+func (d dirArchive) Append(ctx context.Context, name string, data []byte) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//Open implements Archive
+func (d dirArchive) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, errNotFound
+	}
+	return f, err
+}
+
+//ArchivedResource is a snapshot as written to the archive
+//the data of "seen again" markers is resolved so every line stands on its own
+type ArchivedResource struct {
+	URI       string          `json:"uri"`
+	Type      string          `json:"type"`
+	EventType string          `json:"event_type,omitempty"`
+	HookDate  string          `json:"hookdate"`
+	FetchDate time.Time       `json:"fetchdate"`
+	Sha1      string          `json:"sha1"`
+	Deleted   bool            `json:"deleted,omitempty"`
+	Drift     bool            `json:"drift,omitempty"`
+	Data      json.RawMessage `json:"resource,omitempty"`
+}
+
+//archiveName returns the name of the archive file for a snapshot
+func archiveName(res *Resource) string {
+	return res.Type + "/" + res.FetchDate.UTC().Format("2006-01-02") + ".jsonl.gz"
+}
+
+//archiveSnapshots appends the snapshots saved under keys to the archive files of their type and day
+//they are read one at a time as the purge only hands us their keys,
+//a purge step retried after this but before the delete appends the same lines again
+//which restoreArchive skips
+func archiveSnapshots(ctx context.Context, keys []string) error {
+	lines := make(map[string]*bytes.Buffer)
+	cache := make(map[string][]byte)
+	for _, key := range keys {
+		snapshot, err := store.Get(ctx, key)
+		if err == errNotFound {
+			//purged by an earlier attempt
+			continue
+		} else if err != nil {
+			return err
+		}
+		res := *snapshot
+		if err := resolveData(ctx, &res, cache); err != nil {
+			return err
+		}
+		ar := ArchivedResource{
+			URI:       res.URI,
+			Type:      res.Type,
+			EventType: res.EventType,
+			HookDate:  res.HookDate,
+			FetchDate: res.FetchDate,
+			Sha1:      res.Sha1,
+			Deleted:   res.Deleted,
+			Drift:     res.Drift,
+		}
+		if len(res.Data) > 0 {
+			var data bytes.Buffer
+			if _, err := unpackTo(&data, bytes.NewReader(res.Data)); err != nil {
+				return err
+			}
+			ar.Data = data.Bytes()
+		}
+		name := archiveName(&res)
+		if lines[name] == nil {
+			lines[name] = new(bytes.Buffer)
+		}
+		//Encode ends every line with a newline
+		if err := json.NewEncoder(lines[name]).Encode(&ar); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var member bytes.Buffer
+		if err := writeGzipMember(&member, lines[name].Bytes()); err != nil {
+			return err
+		}
+		if err := archive.Append(ctx, name, member.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//restoreArchive imports the snapshots of the archive file name back into the store
+//snapshots that are already there are skipped so restoring twice is harmless
+func restoreArchive(ctx context.Context, name string) (int, error) {
+	if archive == nil {
+		return 0, fmt.Errorf("no ArchiveDir configured")
+	}
+	f, err := archive.Open(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	restored := 0
+	dec := json.NewDecoder(gz)
+	for {
+		var ar ArchivedResource
+		if err := dec.Decode(&ar); err == io.EOF {
+			break
+		} else if err != nil {
+			return restored, err
+		}
+		var existing Resource
+		err := store.Query(ctx, ResourceQuery{URI: ar.URI, Since: ar.FetchDate, Until: ar.FetchDate}).Next(&existing)
+		if err == nil {
+			continue
+		} else if err != iterator.Done {
+			return restored, err
+		}
+		r := Resource{
+			URI:       ar.URI,
+			Type:      ar.Type,
+			EventType: ar.EventType,
+			HookDate:  ar.HookDate,
+			FetchDate: ar.FetchDate,
+			Sha1:      ar.Sha1,
+			Deleted:   ar.Deleted,
+			Drift:     ar.Drift,
+		}
+		if len(ar.Data) > 0 {
+			pr, err := pack(bytes.NewReader(ar.Data))
+			if err != nil {
+				return restored, err
+			}
+			if r.Data, err = ioutil.ReadAll(pr); err != nil {
+				return restored, err
+			}
+		}
+		if _, err := store.Put(ctx, &r); err != nil {
+			log.Printf("unable to store resource %#v", r)
+			return restored, err
+		}
+		restored++
+	}
+	log.Printf("restored %d snapshots from %s", restored, name)
+	return restored, nil
+}
+
+func restoreTask(ctx context.Context, body io.Reader) error {
+	var name string
+	if err := json.NewDecoder(body).Decode(&name); err != nil {
+		log.Printf("trouble reading request body: %v", err)
+		return err
+	}
+	_, err := restoreArchive(ctx, name)
+	if err == errNotFound {
+		//retrying will not make the file appear
+		log.Printf("abandon restore, no archive %s", name)
+		return nil
+	}
+	return err
+}
+
+//restoreView schedules the restore of the archive file given by the file parameter
+func restoreView(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if archive == nil {
+		http.Error(w, "no ArchiveDir configured", http.StatusNotFound)
+		return
+	}
+	name := r.URL.Query().Get("file")
+	if err := validArchiveName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	restoreLater(r.Context(), name)
+	fmt.Fprintf(w, "OK")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//FetchDelay is the pause between fetching two resources during a backfill
+//or a reconciliation so that we do not hammer the REST API
+const FetchDelay = 250 * time.Millisecond
+
+//waitFetchDelay sleeps for FetchDelay unless ctx is done first
+func waitFetchDelay(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(FetchDelay):
+		return nil
+	}
+}
+
+//BackfillArgs is the state of a backfill carried from one step to the next
+type BackfillArgs struct {
+	Resource string
+	//Page is the URL of the collection page to process next
+	Page string
+}
+
+//apiPage is one page of a REST API collection
+type apiPage struct {
+	Results []*hookDataAttr `json:"results"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+//apiURL returns the REST API URL of path
+func apiURL(path string) string {
+	base := cfg.APIBase
+	if base == "" {
+		base = "https://rest.gadventures.com/"
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+//backfillPage snapshots every resource listed on a collection page
+//it returns the URL of the next page or an empty string on the last page
+func backfillPage(ctx context.Context, resource, page string) (string, error) {
+	resp, err := apiGet(ctx, page)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d for %s", resp.StatusCode, page)
+	}
+	var p apiPage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 8*1024*1024)).Decode(&p); err != nil {
+		return "", err
+	}
+	for i, item := range p.Results {
+		if i > 0 {
+			if err := waitFetchDelay(ctx); err != nil {
+				return "", err
+			}
+		}
+		hook := &hookStruct{
+			EventType: resource + ".backfill",
+			Resource:  resource,
+			Created:   time.Now().UTC().Format(jsLayout),
+			Data:      item,
+		}
+		//a single broken resource should not stall the whole backfill
+		if err := saveResource(ctx, hook); err != nil {
+			log.Printf("backfill failed to save %s: %v", item.Href, err)
+		}
+	}
+	for _, link := range p.Links {
+		if link.Rel == "next" {
+			return link.Href, nil
+		}
+	}
+	return "", nil
+}
+
+//backfill runs a whole backfill of resource in the current goroutine
+//starting from the collection page at URL page or from the first page when empty
+func backfill(ctx context.Context, resource, page string) error {
+	if isIgnored(resource) {
+		return fmt.Errorf("%s is an ignored resource type", resource)
+	}
+	if page == "" {
+		page = apiURL(resource + "/")
+	}
+	for page != "" {
+		log.Printf("backfilling %s", page)
+		next, err := backfillPage(ctx, resource, page)
+		if err != nil {
+			log.Printf("backfill of %s stopped, resume it with -page %s", resource, page)
+			return err
+		}
+		page = next
+	}
+	return nil
+}
+
+func backfillTask(ctx context.Context, body io.Reader) error {
+	var arg BackfillArgs
+	if err := json.NewDecoder(body).Decode(&arg); err != nil {
+		log.Printf("trouble reading request body: %v", err)
+		return err
+	}
+	next, err := backfillPage(ctx, arg.Resource, arg.Page)
+	if err != nil {
+		log.Printf("trouble backfilling %s: %v", arg.Page, err)
+		return err
+	}
+	if next != "" {
+		backfillStepLater(ctx, BackfillArgs{Resource: arg.Resource, Page: next})
+	} else {
+		log.Printf("backfill of %s done", arg.Resource)
+	}
+	return nil
+}
+
+//backfillView starts a backfill of the resource type given by the resource parameter
+func backfillView(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		http.Error(w, "missing resource", http.StatusBadRequest)
+		return
+	}
+	if isIgnored(resource) {
+		http.Error(w, resource+" is an ignored resource type", http.StatusBadRequest)
+		return
+	}
+	backfillStepLater(r.Context(), BackfillArgs{Resource: resource, Page: apiURL(resource + "/")})
+	fmt.Fprintf(w, "OK")
+}
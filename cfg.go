@@ -9,6 +9,40 @@ import (
 
 var cfg struct {
 	AppKey string
+	//Store selects the ResourceStore backend (datastore or bolt), defaults to datastore
+	Store string
+	//StorePath is the database file used by the bolt store
+	StorePath string
+	//Queue selects the TaskDispatcher (cloudtasks or local), defaults to cloudtasks
+	Queue string
+	//Workers is the number of goroutines running tasks for the local queue
+	Workers int
+	//QueuePath is the file journaling pending tasks of the local queue
+	QueuePath string
+	//AdminKey guards the admin endpoints, they are disabled when empty
+	AdminKey string
+	//APIBase is the root of the REST API, defaults to https://rest.gadventures.com/
+	APIBase string
+	//ReconcileSample is the fraction of known resources re-fetched by each reconcile run, all of them when 0
+	ReconcileSample float64
+	//Retention maps resource types to the rule purging their snapshots, the "*" rule applies to all other types
+	Retention map[string]RetentionRule
+	//HookLogDays is how many days received webhook batches are kept, DefaultRetentionDays when 0 and forever when negative
+	HookLogDays int
+	//ArchiveDir is where purged snapshots are archived before they are deleted, they are just deleted when empty
+	ArchiveDir string
+	//Subscribers are notified about changed resources
+	Subscribers []Subscriber
+	//WatchRules raise alerts when fields of new snapshots change
+	WatchRules []WatchRule
+	//Notifiers deliver the alerts, WatchRule.Notify refers to them by name
+	Notifiers map[string]NotifierConfig
+	//PrivateTypes can only be read with an API key, defaults to documents, refunds, payments and agents
+	PrivateTypes []string
+	//AllowedTypes are the only resource types stored when set
+	AllowedTypes []string
+	//IgnoredTypes are never fetched nor stored
+	IgnoredTypes []string
 }
 
 func init() {
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/iterator"
+)
+
+//Change is a single difference between two JSON documents
+//Path is a JSON Pointer (RFC 6901) into the documents
+type Change struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Old   interface{} `json:"old,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+//the operations used in Change, named after JSON Patch (RFC 6902)
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+)
+
+//diffJSON appends the changes needed to turn a into b to changes
+//objects are compared key by key and arrays index by index
+func diffJSON(path string, a, b interface{}, changes []Change) []Change {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + escapePointer(k)
+			old, inA := av[k]
+			val, inB := bv[k]
+			switch {
+			case !inB:
+				changes = append(changes, Change{Op: OpRemove, Path: p, Old: old})
+			case !inA:
+				changes = append(changes, Change{Op: OpAdd, Path: p, Value: val})
+			default:
+				changes = diffJSON(p, old, val, changes)
+			}
+		}
+		return changes
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(av) || i < len(bv); i++ {
+			p := path + "/" + strconv.Itoa(i)
+			switch {
+			case i >= len(bv):
+				changes = append(changes, Change{Op: OpRemove, Path: p, Old: av[i]})
+			case i >= len(av):
+				changes = append(changes, Change{Op: OpAdd, Path: p, Value: bv[i]})
+			default:
+				changes = diffJSON(p, av[i], bv[i], changes)
+			}
+		}
+		return changes
+	}
+	if !reflect.DeepEqual(a, b) {
+		changes = append(changes, Change{Op: OpReplace, Path: path, Old: a, Value: b})
+	}
+	return changes
+}
+
+//escapePointer escapes a key for use in a JSON Pointer
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+//decodeData returns the JSON document held by a snapshot
+func (r *Resource) decodeData() (interface{}, error) {
+	if len(r.Data) == 0 {
+		return nil, nil
+	}
+	rdr, err := unpack(bytes.NewReader(r.Data))
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	dec := json.NewDecoder(rdr)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+//snapshotAt returns the snapshot of uri in effect at t with its data resolved
+func snapshotAt(ctx context.Context, uri string, t time.Time) (*Resource, error) {
+	var res Resource
+	err := store.Query(ctx, ResourceQuery{URI: uri, Until: t}).Next(&res)
+	if err == iterator.Done {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if err := resolveData(ctx, &res, make(map[string][]byte)); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+//previousSnapshot returns the snapshot to was changed from
+//"seen again" markers are skipped as they hold the same data as the snapshot they refer to
+func previousSnapshot(ctx context.Context, to *Resource) (*Resource, error) {
+	t := store.Query(ctx, ResourceQuery{URI: to.URI, Until: to.FetchDate.Add(-time.Nanosecond)})
+	for {
+		var res Resource
+		if err := t.Next(&res); err == iterator.Done {
+			return nil, errNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		if res.Ref == "" && res.Key != to.Ref {
+			return &res, nil
+		}
+	}
+}
+
+//DiffResult is the response of the diff endpoint
+type DiffResult struct {
+	URI     string       `json:"uri"`
+	From    SnapshotMeta `json:"from"`
+	To      SnapshotMeta `json:"to"`
+	Changes []Change     `json:"changes"`
+}
+
+//parseTimeParam reads an RFC3339 time from the query string returning def when it is missing
+func parseTimeParam(r *http.Request, name string, def time.Time) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+//diffView answers /d/{type}/{id}?from=&to= with the changes between the snapshots
+//in effect at from and to, to defaults to now and from to the last snapshot with different data before to
+func diffView(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r)
+	w.Header().Add("content-type", "application/json")
+
+	uri, ok := resourceURIFromPath(w, r, "/d/")
+	if !ok {
+		return
+	}
+	to, err := parseTimeParam(r, "to", time.Now().UTC())
+	if err != nil {
+		http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseTimeParam(r, "from", time.Time{})
+	if err != nil {
+		http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := r.Context()
+	toRes, err := snapshotAt(c, uri, to)
+	if err == errNotFound {
+		http.Error(w, "no snapshot at to", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to query snapshot of %s at %v: %v", uri, to, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var fromRes *Resource
+	if from.IsZero() {
+		fromRes, err = previousSnapshot(c, toRes)
+	} else {
+		fromRes, err = snapshotAt(c, uri, from)
+	}
+	if err == errNotFound {
+		http.Error(w, "no snapshot at from", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to query snapshot of %s at %v: %v", uri, from, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	a, err := fromRes.decodeData()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := toRes.decodeData()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := DiffResult{
+		URI:     uri,
+		From:    fromRes.Meta(),
+		To:      toRes.Meta(),
+		Changes: diffJSON("", a, b, []Change{}),
+	}
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		log.Printf("Failed to write diff of %s: %v", uri, err)
+	}
+}
@@ -14,7 +14,10 @@ import OrderedDict as Od
 type alias Model =
     { fetchdate : String
     , hookdate : String
+    , eventType : String
     , sha1 : String
+    , deleted : Bool
+    , drift : Bool
     , resource : Generic.Value
     }
 
@@ -27,7 +30,10 @@ decode =
     Decode.succeed Model
         |> Pipeline.required "fetchdate" Decode.string
         |> Pipeline.required "hookdate" Decode.string
+        |> Pipeline.optional "event_type" Decode.string ""
         |> Pipeline.required "sha1" Decode.string
+        |> Pipeline.optional "deleted" Decode.bool False
+        |> Pipeline.optional "drift" Decode.bool False
         |> Pipeline.required "resource" Generic.fromJson
 
 
@@ -46,14 +52,31 @@ render model =
         text =
             Html.text
     in
-    Html.div []
-        [ Html.ul []
-            [ li [] [ text <| "SHA1: " ++ model.sha1 ]
-            , li [] [ text <| "Fetch Date: " ++ model.fetchdate ]
-            , li [] [ text <| "Hook Date: " ++ model.hookdate ]
+    if model.deleted then
+        Html.div []
+            [ Html.ul []
+                [ li [ Attributes.class "deleted" ] [ text "Deleted" ]
+                , li [] [ text <| "Fetch Date: " ++ model.fetchdate ]
+                , li [] [ text <| "Hook Date: " ++ model.hookdate ]
+                ]
+            ]
+
+    else
+        Html.div []
+            [ Html.ul [] <|
+                [ li [] [ text <| "SHA1: " ++ model.sha1 ]
+                , li [] [ text <| "Fetch Date: " ++ model.fetchdate ]
+                , li [] [ text <| "Hook Date: " ++ model.hookdate ]
+                , li [] [ text <| "Event: " ++ model.eventType ]
+                ]
+                    ++ (if model.drift then
+                            [ li [ Attributes.class "drift" ] [ text "Drift detected" ] ]
+
+                        else
+                            []
+                       )
+            , Html.div [ Attributes.class "jsview" ] [ renderValue model.resource ]
             ]
-        , Html.div [ Attributes.class "jsview" ] [ renderValue model.resource ]
-        ]
 
 
 renderValue : Generic.Value -> Html.Html Msg
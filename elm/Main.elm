@@ -1,4 +1,4 @@
-module Main exposing (main)
+port module Main exposing (main)
 
 --not super certain why elm-format puts the above line in (code compiles without it)
 
@@ -13,6 +13,7 @@ import Http
 import Json.Decode as Json
 import String
 import Task
+import Url
 
 
 main : Program () Model Msg
@@ -77,6 +78,7 @@ type Msg
     | KeyPress Int
     | HistoryMsg Hv.Msg
     | EntryMsg Entry.Msg
+    | Live Json.Value
 
 
 update : Msg -> Model -> ( Model, Cmd Msg )
@@ -129,6 +131,20 @@ update msg model =
         EntryMsg emsg ->
             updateNoOp model
 
+        Live value ->
+            case Json.decodeValue Entry.decode value of
+                Ok entry ->
+                    ( { model
+                        | entries = entry :: model.entries
+                        , currentModel = Just entry
+                        , status = "New version received " ++ entry.fetchdate
+                      }
+                    , Cmd.none
+                    )
+
+                Err error ->
+                    ( { model | error = Json.errorToString error }, Cmd.none )
+
         FetchOfData res ->
             case res of
                 Ok entries ->
@@ -155,7 +171,7 @@ update msg model =
                                         }
                                         model.log
                       }
-                    , Cmd.none
+                    , listenTo model.resourceType resId
                     )
 
                 Err error ->
@@ -256,7 +272,30 @@ renderOption default ( val, label ) =
 
 subscriptions : Model -> Sub Msg
 subscriptions model =
-    Sub.none
+    snapshot Live
+
+
+
+-- PORTS
+
+
+{-| asks the page to stream new snapshots from the given /live url, an empty url stops streaming
+-}
+port listen : String -> Cmd msg
+
+
+{-| new snapshots streamed by the page
+-}
+port snapshot : (Json.Value -> msg) -> Sub msg
+
+
+listenTo : String -> String -> Cmd Msg
+listenTo resType resId =
+    if resId == "" then
+        listen ""
+
+    else
+        listen <| "/live?type=" ++ Url.percentEncode resType ++ "&id=" ++ Url.percentEncode resId
 
 
 
@@ -330,8 +369,15 @@ toSelectTuples acc xs =
 
         hd :: tl ->
             let
+                label =
+                    if hd.deleted then
+                        hd.fetchdate ++ " (deleted)"
+
+                    else
+                        hd.fetchdate
+
                 newacc =
-                    ( List.length acc |> String.fromInt, hd.fetchdate ) :: acc
+                    ( List.length acc |> String.fromInt, label ) :: acc
             in
             toSelectTuples newacc tl
 
@@ -364,18 +410,18 @@ errToString err =
             "Bad Body error: " ++ errmsg
 
 
-{-| retrieve resource id from entries
+{-| retrieve resource id from entries, skipping tombstones which have no resource
 -}
 firstResId : List Entry.Model -> Maybe String
 firstResId entries =
-    case List.head entries of
-        Nothing ->
+    case entries of
+        [] ->
             Nothing
 
-        Just entry ->
+        entry :: rest ->
             case Generic.field "id" entry.resource of
                 Just v ->
                     Generic.toString v
 
                 Nothing ->
-                    Nothing
+                    firstResId rest
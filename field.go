@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/iterator"
+)
+
+//parseFieldPath splits a JSON Pointer (/a/b/0) or a simple JSONPath ($.a.b[0] or a.b[0])
+//into the keys and indexes leading to a value
+func parseFieldPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+	if strings.HasPrefix(path, "/") {
+		tokens := strings.Split(path[1:], "/")
+		for i, t := range tokens {
+			tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+		}
+		return tokens, nil
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var tokens []string
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+			rest := part[i:]
+			if name != "" {
+				tokens = append(tokens, name)
+			}
+			for rest != "" {
+				end := strings.Index(rest, "]")
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("malformed path segment %q", part)
+				}
+				tokens = append(tokens, strings.Trim(rest[1:end], `'"`))
+				rest = rest[end+1:]
+			}
+			continue
+		}
+		if name == "" {
+			return nil, fmt.Errorf("malformed path %q", path)
+		}
+		tokens = append(tokens, name)
+	}
+	return tokens, nil
+}
+
+//lookupPath returns the value found by following tokens from doc
+func lookupPath(doc interface{}, tokens []string) (interface{}, bool) {
+	for _, t := range tokens {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			val, ok := v[t]
+			if !ok {
+				return nil, false
+			}
+			doc = val
+		case []interface{}:
+			i, err := strconv.Atoi(t)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+//FieldValue is a value a field took and the snapshot where it first appeared
+type FieldValue struct {
+	SnapshotMeta
+	Value   interface{} `json:"value"`
+	Missing bool        `json:"missing,omitempty"`
+}
+
+//fieldHistory walks the snapshots of uri oldest first and records every distinct value
+//of the field at tokens with the snapshot where it first appeared
+func fieldHistory(ctx context.Context, uri string, tokens []string) ([]FieldValue, error) {
+	var history = []FieldValue{}
+	t := store.Query(ctx, ResourceQuery{URI: uri, Ascending: true})
+	for {
+		var res Resource
+		if err := t.Next(&res); err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		//"seen again" markers can not change the value
+		if res.Ref != "" {
+			continue
+		}
+		doc, err := res.decodeData()
+		if err != nil {
+			return nil, err
+		}
+		val, found := lookupPath(doc, tokens)
+		if seenValue(history, val, found) {
+			continue
+		}
+		history = append(history, FieldValue{SnapshotMeta: res.Meta(), Value: val, Missing: !found})
+	}
+	return history, nil
+}
+
+//seenValue reports whether the field already had val, or was already missing when not found
+func seenValue(history []FieldValue, val interface{}, found bool) bool {
+	for _, fv := range history {
+		if fv.Missing == !found && reflect.DeepEqual(fv.Value, val) {
+			return true
+		}
+	}
+	return false
+}
+
+//fieldView answers /f/{type}/{id}?path= with the distinct values a single field had over time
+func fieldView(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r)
+	w.Header().Add("content-type", "application/json")
+
+	uri, ok := resourceURIFromPath(w, r, "/f/")
+	if !ok {
+		return
+	}
+	tokens, err := parseFieldPath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, "path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	history, err := fieldHistory(r.Context(), uri, tokens)
+	if err != nil {
+		log.Printf("Failed to query field history of %s: %v", uri, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		log.Printf("Failed to write field history of %s: %v", uri, err)
+	}
+}
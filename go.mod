@@ -4,6 +4,8 @@ go 1.12
 
 require (
 	cloud.google.com/go v0.43.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5 // indirect
 	google.golang.org/api v0.7.0
 	google.golang.org/genproto v0.0.0-20190716160619-c506a9f90610
 )
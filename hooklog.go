@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//HookBatch is a webhook delivery as we received it
+type HookBatch struct {
+	Received time.Time
+	Valid    bool
+	//Headers are the request headers encoded as JSON
+	Headers string `datastore:",noindex"`
+	//Resources and EventTypes list what the events in the batch are about so we can search them
+	Resources  []string
+	EventTypes []string
+	//Data is the packed request body
+	Data  []byte `datastore:",noindex"`
+	Error string `datastore:",noindex"`
+	Key   string `datastore:"-"`
+}
+
+//JSONHookBatch is the same as HookBatch but more suitable for serializing
+type JSONHookBatch struct {
+	Key      string              `json:"key"`
+	Received string              `json:"received"`
+	Valid    bool                `json:"valid"`
+	Headers  map[string][]string `json:"headers"`
+	Events   []*hookStruct       `json:"events"`
+	Error    string              `json:"error,omitempty"`
+}
+
+//matches reports whether the batch is selected by the filters of q
+func (b *HookBatch) matches(q BatchQuery) bool {
+	if !q.Since.IsZero() && b.Received.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && b.Received.After(q.Until) {
+		return false
+	}
+	return (q.Resource == "" || contains(b.Resources, q.Resource)) &&
+		(q.EventType == "" || contains(b.EventTypes, q.EventType))
+}
+
+//events decodes the hooks in the batch
+func (b *HookBatch) events() ([]*hookStruct, error) {
+	var events []*hookStruct
+	if len(b.Data) == 0 {
+		return events, nil
+	}
+	r, err := unpack(bytes.NewReader(b.Data))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(r).Decode(&events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+//toJSON returns the serializable form of the batch
+func (b *HookBatch) toJSON() *JSONHookBatch {
+	jsb := &JSONHookBatch{
+		Key:      b.Key,
+		Received: b.Received.Format(jsLayout),
+		Valid:    b.Valid,
+		Error:    b.Error,
+	}
+	if b.Headers != "" {
+		if err := json.Unmarshal([]byte(b.Headers), &jsb.Headers); err != nil {
+			log.Printf("trouble decoding headers of batch %s: %v", b.Key, err)
+		}
+	}
+	events, err := b.events()
+	if err != nil && jsb.Error == "" {
+		jsb.Error = err.Error()
+	}
+	jsb.Events = events
+	return jsb
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//logBatch records a received webhook batch, data is the packed body
+//failing to do so should not lose the hooks so we only log errors
+func logBatch(r *http.Request, data []byte, valid bool) {
+	b := HookBatch{
+		Received: time.Now().UTC(),
+		Valid:    valid,
+	}
+	if !valid {
+		//anyone can post to us so only note the attempt instead of keeping what they sent
+		b.Error = fmt.Sprintf("signature verification failed for a body of %d packed bytes", len(data))
+		if _, err := hookLog.PutBatch(r.Context(), &b); err != nil {
+			log.Printf("unable to store hook batch %v", err)
+		}
+		return
+	}
+	b.Data = data
+	headers, err := json.Marshal(r.Header)
+	if err != nil {
+		log.Printf("trouble encoding headers %v", err)
+	}
+	b.Headers = string(headers)
+	if events, err := b.events(); err != nil {
+		b.Error = err.Error()
+	} else {
+		for _, e := range events {
+			if !contains(b.Resources, e.Resource) {
+				b.Resources = append(b.Resources, e.Resource)
+			}
+			if !contains(b.EventTypes, e.EventType) {
+				b.EventTypes = append(b.EventTypes, e.EventType)
+			}
+		}
+	}
+	if len(b.Data) > MaxDataStoreByteSize {
+		b.Data = nil
+		b.Error = fmt.Sprintf("body of %d bytes is too large to keep", len(data))
+	}
+	if _, err := hookLog.PutBatch(r.Context(), &b); err != nil {
+		log.Printf("unable to store hook batch %v", err)
+	}
+}
+
+//MaxBatchesPerPage is the most batches eventsView returns at once
+const MaxBatchesPerPage = 500
+
+//eventsView answers /events with the received webhook batches newest first
+//filtered by the resource, event_type, since and until parameters
+//and paged with limit and cursor
+func eventsView(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("content-type", "application/json")
+	var err error
+	q := BatchQuery{
+		Resource:  r.URL.Query().Get("resource"),
+		EventType: r.URL.Query().Get("event_type"),
+		Cursor:    r.URL.Query().Get("cursor"),
+		Limit:     50,
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > MaxBatchesPerPage {
+			http.Error(w, fmt.Sprintf("limit: expected a number between 1 and %d", MaxBatchesPerPage), http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Since, err = parseTimeParam(r, "since", time.Time{}); err != nil {
+		http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = parseTimeParam(r, "until", time.Time{}); err != nil {
+		http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	batches, next, err := hookLog.QueryBatches(r.Context(), q)
+	if err != nil {
+		log.Printf("Failed to query hook batches %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := make([]*JSONHookBatch, 0, len(batches))
+	for _, b := range batches {
+		list = append(list, b.toJSON())
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+//eventView answers /events/{key} with a single batch
+//and replays it through processHook on POST /events/{key}/replay
+func eventView(w http.ResponseWriter, r *http.Request) {
+	key := getURLPart("/events/", r.URL.Path, 0)
+	action := getURLPart("/events/", r.URL.Path, 1)
+	b, err := hookLog.GetBatch(r.Context(), key)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get hook batch %s %v", key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch action {
+	case "":
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(b.toJSON())
+	case "replay":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := replayBatch(r.Context(), b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "OK")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//replayBatch runs processHook again for a stored batch
+func replayBatch(ctx context.Context, b *HookBatch) error {
+	if !b.Valid {
+		return fmt.Errorf("batch %s failed signature verification", b.Key)
+	}
+	if len(b.Data) == 0 {
+		return fmt.Errorf("batch %s has no data", b.Key)
+	}
+	log.Printf("replaying hook batch %s", b.Key)
+	return processHookLater(ctx, b.Data)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+//bucket names used by boltJournal
+var (
+	bktJobs     = []byte("jobs")
+	bktDeadJobs = []byte("dead_jobs")
+)
+
+//jobJournal persists the jobs of the local queue so they survive restarts
+type jobJournal interface {
+	//Save records a new or retried job assigning it an ID when it has none
+	Save(job *localJob) error
+	//Remove forgets a job that completed
+	Remove(job *localJob) error
+	//Bury moves a job that will not be retried to the dead letter list
+	Bury(job *localJob) error
+	//Pending returns all jobs that still have to run
+	Pending() ([]*localJob, error)
+	//Due returns up to limit jobs that should run by now in the order they were added
+	//leaving out the jobs skip reports
+	Due(now time.Time, limit int, skip func(id uint64) bool) ([]*localJob, error)
+	//Dead returns the dead letter list
+	Dead() ([]*localJob, error)
+	//Requeue moves the job id from the dead letter list back to the pending jobs
+	//giving it a fresh set of attempts
+	Requeue(id uint64) error
+}
+
+//boltJournal is a jobJournal kept in a BoltDB file
+type boltJournal struct {
+	db *bolt.DB
+}
+
+func newBoltJournal(path string) (*boltJournal, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bktJobs, bktDeadJobs} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltJournal{db}, nil
+}
+
+//Close releases the underlying database file
+func (j *boltJournal) Close() error {
+	return j.db.Close()
+}
+
+//Save implements jobJournal
+func (j *boltJournal) Save(job *localJob) error {
+	return j.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktJobs)
+		if job.ID == 0 {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			job.ID = seq
+		}
+		return putJob(b, job)
+	})
+}
+
+//Remove implements jobJournal
+func (j *boltJournal) Remove(job *localJob) error {
+	return j.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bktJobs).Delete(encodeUint(job.ID))
+	})
+}
+
+//Bury implements jobJournal
+func (j *boltJournal) Bury(job *localJob) error {
+	return j.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bktJobs).Delete(encodeUint(job.ID)); err != nil {
+			return err
+		}
+		return putJob(tx.Bucket(bktDeadJobs), job)
+	})
+}
+
+//Pending implements jobJournal
+func (j *boltJournal) Pending() ([]*localJob, error) {
+	return j.list(bktJobs, func(*localJob) bool { return true }, 0)
+}
+
+//Due implements jobJournal
+func (j *boltJournal) Due(now time.Time, limit int, skip func(id uint64) bool) ([]*localJob, error) {
+	return j.list(bktJobs, func(job *localJob) bool { return !job.NextRun.After(now) && !skip(job.ID) }, limit)
+}
+
+//Dead implements jobJournal
+func (j *boltJournal) Dead() ([]*localJob, error) {
+	return j.list(bktDeadJobs, func(*localJob) bool { return true }, 0)
+}
+
+//Requeue implements jobJournal
+func (j *boltJournal) Requeue(id uint64) error {
+	return j.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(bktDeadJobs)
+		job, err := decodeJob(dead.Get(encodeUint(id)))
+		if err != nil {
+			return err
+		}
+		if err := dead.Delete(encodeUint(id)); err != nil {
+			return err
+		}
+		job.Attempts = 0
+		job.NextRun = time.Now().UTC()
+		return putJob(tx.Bucket(bktJobs), job)
+	})
+}
+
+//list returns up to limit jobs of bucket accepted by keep, all of them when limit is 0
+func (j *boltJournal) list(bucket []byte, keep func(*localJob) bool, limit int) ([]*localJob, error) {
+	var jobs []*localJob
+	err := j.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.First(); k != nil && (limit == 0 || len(jobs) < limit); k, v = c.Next() {
+			job, err := decodeJob(v)
+			if err != nil {
+				return err
+			}
+			if keep(job) {
+				jobs = append(jobs, job)
+			}
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+func decodeJob(data []byte) (*localJob, error) {
+	if data == nil {
+		return nil, errNotFound
+	}
+	var job localJob
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func putJob(b *bolt.Bucket, job *localJob) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(job); err != nil {
+		return err
+	}
+	return b.Put(encodeUint(job.ID), buf.Bytes())
+}
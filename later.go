@@ -16,12 +16,48 @@ const (
 	queueID    = "default"
 )
 
-func createTask(ctx context.Context, handlerPath string, payload []byte) (*tasks.Task, error) {
+//TaskDispatcher schedules a task handler to be run later with the given payload
+type TaskDispatcher interface {
+	Dispatch(ctx context.Context, handlerPath string, payload []byte) error
+}
+
+//dispatcher is the TaskDispatcher used by the *Later functions, set up by openDispatcher
+var dispatcher TaskDispatcher
+
+func openDispatcher(ctx context.Context) (TaskDispatcher, error) {
+	switch cfg.Queue {
+	case "", "cloudtasks":
+		return newCloudTasksDispatcher(ctx)
+	case "local":
+		path := cfg.QueuePath
+		if path == "" {
+			path = "res-log-queue.db"
+		}
+		journal, err := newBoltJournal(path)
+		if err != nil {
+			return nil, err
+		}
+		return newLocalQueue(taskFuncs, cfg.Workers, journal)
+	default:
+		return nil, fmt.Errorf("unknown queue %q", cfg.Queue)
+	}
+}
+
+//cloudTasksDispatcher sends tasks to Cloud Tasks targeting our App Engine handlers
+type cloudTasksDispatcher struct {
+	client *cloudtasks.Client
+}
+
+func newCloudTasksDispatcher(ctx context.Context) (*cloudTasksDispatcher, error) {
 	client, err := cloudtasks.NewClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("NewClient: %v", err)
 	}
+	return &cloudTasksDispatcher{client}, nil
+}
 
+//Dispatch implements TaskDispatcher
+func (d *cloudTasksDispatcher) Dispatch(ctx context.Context, handlerPath string, payload []byte) error {
 	queuePath := fmt.Sprintf("projects/%s/locations/%s/queues/%s", projectID, locationID, queueID)
 
 	req := &tasks.CreateTaskRequest{
@@ -37,47 +73,50 @@ func createTask(ctx context.Context, handlerPath string, payload []byte) (*tasks
 		},
 	}
 
-	createdTask, err := client.CreateTask(ctx, req)
-	if err != nil {
-		return nil, fmt.Errorf("cloudtasks.CreateTask: %v", err)
+	if _, err := d.client.CreateTask(ctx, req); err != nil {
+		return fmt.Errorf("cloudtasks.CreateTask: %v", err)
 	}
-
-	return createdTask, nil
+	return nil
 }
 
 //processes the payload received from G's webhook delivery system
-func processHookLater(ctx context.Context, data []byte) {
-	if _, err := createTask(ctx, "/task/process_hook", data); err != nil {
+//the error is returned so that the hooks are not lost when they can not be scheduled
+func processHookLater(ctx context.Context, data []byte) error {
+	if err := dispatcher.Dispatch(ctx, "/task/process_hook", data); err != nil {
 		log.Printf("trouble scheduling task %v", err)
+		return err
 	}
+	return nil
 }
 
 //fetches and stores one single webhook
-func saveResourceLater(ctx context.Context, hook *hookStruct) {
+func saveResourceLater(ctx context.Context, hook *hookStruct) error {
 	body, err := json.Marshal(hook)
 	if err != nil {
 		log.Printf("trouble encoding %v -> %v", hook, err)
-		return
+		return err
 	}
-	if _, err := createTask(ctx, "/task/save_resource", body); err != nil {
+	if err := dispatcher.Dispatch(ctx, "/task/save_resource", body); err != nil {
 		log.Printf("trouble scheduling task %v", err)
+		return err
 	}
-
+	return nil
 }
 
-//purgeBeforeLate is expecting time stamp anything older than stamp will be scheduled for deletion
-func purgeBeforeLater(ctx context.Context, t time.Time) {
+//purgeLater starts a purge applying the retention rules counted back from t
+func purgeLater(ctx context.Context, t time.Time) {
 	body, err := json.Marshal(t)
 	if err != nil {
 		log.Printf("trouble encoding %v -> %v", t, err)
 		return
 	}
-	if _, err := createTask(ctx, "/task/purge_before", body); err != nil {
+	if err := dispatcher.Dispatch(ctx, "/task/purge_before", body); err != nil {
 		log.Printf("trouble scheduling task %v", err)
 	}
 }
 
 type LaterStepArgs struct {
+	//When is the time the purge started, retention is counted back from it
 	When   time.Time
 	Cursor string
 }
@@ -92,7 +131,67 @@ func purgeStepLater(ctx context.Context, when time.Time, msg string) {
 	if err != nil {
 		log.Printf("trouble encoding json %v", err)
 	}
-	if _, err := createTask(ctx, "/task/purge_step", body); err != nil {
+	if err := dispatcher.Dispatch(ctx, "/task/purge_step", body); err != nil {
+		log.Printf("trouble scheduling task %v", err)
+	}
+}
+
+//backfillStepLater continues a backfill with the page in arg
+func backfillStepLater(ctx context.Context, arg BackfillArgs) {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		log.Printf("trouble encoding json %v", err)
+		return
+	}
+	if err := dispatcher.Dispatch(ctx, "/task/backfill", body); err != nil {
+		log.Printf("trouble scheduling task %v", err)
+	}
+}
+
+//reconcileStepLater continues a reconcile run from the state in arg
+func reconcileStepLater(ctx context.Context, arg ReconcileArgs) {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		log.Printf("trouble encoding json %v", err)
+		return
+	}
+	if err := dispatcher.Dispatch(ctx, "/task/reconcile", body); err != nil {
+		log.Printf("trouble scheduling task %v", err)
+	}
+}
+
+//restoreLater imports the archive file name back into the store
+func restoreLater(ctx context.Context, name string) {
+	body, err := json.Marshal(name)
+	if err != nil {
+		log.Printf("trouble encoding json %v", err)
+		return
+	}
+	if err := dispatcher.Dispatch(ctx, "/task/restore", body); err != nil {
+		log.Printf("trouble scheduling task %v", err)
+	}
+}
+
+//notifyLater sends a change notification to a subscriber retrying until it gets through
+func notifyLater(ctx context.Context, arg NotifyArgs) {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		log.Printf("trouble encoding json %v", err)
+		return
+	}
+	if err := dispatcher.Dispatch(ctx, "/task/notify", body); err != nil {
+		log.Printf("trouble scheduling task %v", err)
+	}
+}
+
+//alertLater delivers an alert through a notifier retrying until it gets through
+func alertLater(ctx context.Context, arg AlertArgs) {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		log.Printf("trouble encoding json %v", err)
+		return
+	}
+	if err := dispatcher.Dispatch(ctx, "/task/alert", body); err != nil {
 		log.Printf("trouble scheduling task %v", err)
 	}
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//LiveBufferSize is how many snapshots wait for a slow live client before it starts missing them
+const LiveBufferSize = 16
+
+//LivePingInterval is how often idle live connections get a comment to keep proxies from closing them
+const LivePingInterval = 30 * time.Second
+
+//liveFilter selects the snapshots a live client gets, by type and optionally uri
+type liveFilter struct {
+	Type string
+	URI  string
+}
+
+func (f liveFilter) matches(r *Resource) bool {
+	return r.Type == f.Type && (f.URI == "" || r.URI == f.URI)
+}
+
+//liveFeed hands the snapshots saved by this instance to the live clients listening for them
+type liveFeed struct {
+	mu      sync.Mutex
+	clients map[chan *Resource]liveFilter
+}
+
+//feed is the liveFeed saveResource publishes to
+var feed = &liveFeed{clients: make(map[chan *Resource]liveFilter)}
+
+func (f *liveFeed) subscribe(filter liveFilter) chan *Resource {
+	ch := make(chan *Resource, LiveBufferSize)
+	f.mu.Lock()
+	f.clients[ch] = filter
+	f.mu.Unlock()
+	return ch
+}
+
+func (f *liveFeed) unsubscribe(ch chan *Resource) {
+	f.mu.Lock()
+	delete(f.clients, ch)
+	f.mu.Unlock()
+}
+
+//publish sends a copy of r to every matching client without waiting for slow ones
+func (f *liveFeed) publish(r *Resource) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch, filter := range f.clients {
+		if !filter.matches(r) {
+			continue
+		}
+		res := *r
+		select {
+		case ch <- &res:
+		default:
+			log.Printf("live client of %s is too slow, dropping snapshot %s", filter.Type, r.Key)
+		}
+	}
+}
+
+//writeEvent writes a snapshot as a server-sent event named snapshot
+func writeEvent(w http.ResponseWriter, res *Resource) error {
+	jsr, err := res.fullJSONResource()
+	if err != nil {
+		return err
+	}
+	jsr.URI = res.URI
+	data, err := json.Marshal(&jsr)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: snapshot\ndata: %s\n\n", res.Key, data)
+	return err
+}
+
+//liveView answers /live?type=&id= with a stream of server-sent events
+//carrying every new snapshot of the type or of the single resource when id is given
+func liveView(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r)
+	filter := liveFilter{Type: r.URL.Query().Get("type")}
+	if filter.Type == "" {
+		http.Error(w, "missing resource type", http.StatusBadRequest)
+		return
+	}
+	if !authorizeType(w, r, filter.Type) {
+		return
+	}
+	if id := r.URL.Query().Get("id"); id != "" {
+		filter.URI = filter.Type + "/" + id
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := feed.subscribe(filter)
+	defer feed.unsubscribe(ch)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ping := time.NewTicker(LivePingInterval)
+	defer ping.Stop()
+	refs := make(map[string][]byte)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case res := <-ch:
+			if err := resolveData(r.Context(), res, refs); err != nil {
+				log.Printf("Failed to resolve live snapshot %s: %v", res.Key, err)
+				continue
+			}
+			if err := writeEvent(w, res); err != nil {
+				log.Printf("Failed to write live snapshot %s: %v", res.Key, err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,6 +11,27 @@ import (
 )
 
 func main() {
+	backend, err := openStore(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, hookLog, reconcileLog, alertLog, keyStore = backend, backend, backend, backend, backend
+	dispatcher, err = openDispatcher(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if archive, err = openArchive(); err != nil {
+		log.Fatal(err)
+	}
+
+	//subcommands run once and exit
+	if len(os.Args) > 1 {
+		if err := runCommand(context.Background(), os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	http.Handle("/", getMux())
 	//http.HandleFunc("/", http.NotFound)
 
@@ -26,3 +50,30 @@ func main() {
 	log.Printf("Listening on port %s", port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
 }
+
+//runCommand runs a command line subcommand
+func runCommand(ctx context.Context, args []string) error {
+	switch args[0] {
+	case "backfill":
+		flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+		page := flags.String("page", "", "URL of the collection page to start from")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return fmt.Errorf("usage: %s backfill [-page url] <resource>", os.Args[0])
+		}
+		return backfill(ctx, flags.Arg(0), *page)
+	case "reconcile":
+		report, err := reconcile(ctx)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(report)
+	case "restore":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s restore <type/day.jsonl.gz>", os.Args[0])
+		}
+		_, err := restoreArchive(ctx, args[1])
+		return err
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
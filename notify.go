@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Subscriber is told about changes of the resources it is interested in
+type Subscriber struct {
+	//URL receives the notifications as POST requests
+	URL string
+	//Types limits the notifications to these resource types, all types when empty
+	Types []string
+	//Paths limits the notifications to changes touching these fields given as
+	//JSON Pointers or simple JSONPaths, any change when empty
+	Paths []string
+	//Secret is the key of the HMAC-SHA256 signature sent in the X-Res-Log-Signature header
+	Secret string
+}
+
+//wants reports whether the subscriber is interested in changes to restype
+func (s *Subscriber) wants(restype string) bool {
+	return len(s.Types) == 0 || typeIn(s.Types, restype)
+}
+
+//matches reports whether any of the changes touches one of the subscriber's paths
+func (s *Subscriber) matches(changes []Change) bool {
+	if len(s.Paths) == 0 {
+		return len(changes) > 0
+	}
+	for _, p := range s.Paths {
+		tokens, err := parseFieldPath(p)
+		if err != nil {
+			log.Printf("ignoring path %q of subscriber %s: %v", p, s.URL, err)
+			continue
+		}
+		for i, t := range tokens {
+			tokens[i] = escapePointer(t)
+		}
+		pointer := "/" + strings.Join(tokens, "/")
+		for _, c := range changes {
+			//a change to the field, inside it or replacing a parent of it
+			if c.Path == pointer || strings.HasPrefix(c.Path, pointer+"/") || strings.HasPrefix(pointer, c.Path+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//ChangeNotification is the body POSTed to subscribers
+type ChangeNotification struct {
+	URI       string   `json:"uri"`
+	Type      string   `json:"type"`
+	EventType string   `json:"event_type,omitempty"`
+	Key       string   `json:"key"`
+	FetchDate string   `json:"fetchdate"`
+	OldSha1   string   `json:"old_sha1"`
+	NewSha1   string   `json:"new_sha1"`
+	Changes   []Change `json:"changes"`
+}
+
+//NotifyArgs is a notification waiting to be sent to a subscriber
+type NotifyArgs struct {
+	//Subscriber is the index of the subscriber in cfg.Subscribers
+	Subscriber int
+	//URL is where the subscriber was at so a changed config does not send it elsewhere
+	URL  string
+	Body json.RawMessage
+}
+
+//subscribersFor returns the indexes in cfg.Subscribers of the subscribers wanting changes to restype
+func subscribersFor(restype string) []int {
+	var subscribers []int
+	for i := range cfg.Subscribers {
+		if cfg.Subscribers[i].wants(restype) {
+			subscribers = append(subscribers, i)
+		}
+	}
+	return subscribers
+}
+
+//notifyChange schedules notifications to the subscribers interested in the change
+//from prev to cur whose documents are old and doc, prev is nil for the first snapshot of a resource
+//failing to do so should not fail saving the snapshot so we only log errors
+func notifyChange(ctx context.Context, prev, cur *Resource, old, doc interface{}) {
+	subscribers := subscribersFor(cur.Type)
+	if len(subscribers) == 0 {
+		return
+	}
+	n := ChangeNotification{
+		URI:       cur.URI,
+		Type:      cur.Type,
+		EventType: cur.EventType,
+		Key:       cur.Key,
+		FetchDate: cur.FetchDate.Format(jsLayout),
+		NewSha1:   cur.Sha1,
+	}
+	if prev != nil {
+		n.OldSha1 = prev.Sha1
+	}
+	n.Changes = diffJSON("", old, doc, []Change{})
+	body, err := json.Marshal(&n)
+	if err != nil {
+		log.Printf("trouble encoding %v -> %v", n, err)
+		return
+	}
+	for _, i := range subscribers {
+		if s := &cfg.Subscribers[i]; s.matches(n.Changes) {
+			notifyLater(ctx, NotifyArgs{Subscriber: i, URL: s.URL, Body: body})
+		}
+	}
+}
+
+//changedDocs returns the JSON documents held by prev and cur, prev may be nil
+func changedDocs(ctx context.Context, prev, cur *Resource) (interface{}, interface{}, error) {
+	var old interface{}
+	if prev != nil {
+		res := *prev
+		if err := resolveData(ctx, &res, make(map[string][]byte)); err != nil {
+			return nil, nil, err
+		}
+		var err error
+		if old, err = res.decodeData(); err != nil {
+			return nil, nil, err
+		}
+	}
+	doc, err := cur.decodeData()
+	if err != nil {
+		return nil, nil, err
+	}
+	return old, doc, nil
+}
+
+//sign returns the hex encoded HMAC-SHA256 of body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//notifyClient sends the notifications, a subscriber that does not answer in time gets retried
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+func notifyTask(ctx context.Context, body io.Reader) error {
+	var arg NotifyArgs
+	if err := json.NewDecoder(body).Decode(&arg); err != nil {
+		log.Printf("trouble reading request body: %v", err)
+		return err
+	}
+	//the secret stays in the config instead of travelling with the task
+	if arg.Subscriber < 0 || arg.Subscriber >= len(cfg.Subscribers) || cfg.Subscribers[arg.Subscriber].URL != arg.URL {
+		log.Printf("abandon notification, subscriber %d at %s is no longer configured", arg.Subscriber, arg.URL)
+		return nil
+	}
+	sub := &cfg.Subscribers[arg.Subscriber]
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(arg.Body))
+	if err != nil {
+		log.Printf("failed to build POST request for: %s", sub.URL)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sub.Secret != "" {
+		req.Header.Set("X-Res-Log-Signature", sign(sub.Secret, arg.Body))
+	}
+	resp, err := notifyClient.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Printf("failed to notify: %s", sub.URL)
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, sub.URL)
+	}
+	return nil
+}
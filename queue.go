@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//LocalQueuePoll is how often the journal is checked for tasks that are due
+	LocalQueuePoll = time.Second
+	//LocalTaskRetryLimit is how many times a failing task is attempted before it is abandoned
+	LocalTaskRetryLimit = 20
+	//LocalTaskMinBackoff is the delay before the first retry, doubled on every further attempt
+	LocalTaskMinBackoff = 10 * time.Second
+	//LocalTaskMaxBackoff caps the delay between retries
+	LocalTaskMaxBackoff = 5 * time.Minute
+	//LocalTaskTimeout is how long a single attempt may run
+	LocalTaskTimeout = 10 * time.Minute
+)
+
+//localJob is a task waiting in the local queue
+type localJob struct {
+	ID        uint64
+	Path      string
+	Payload   []byte
+	Attempts  int
+	NextRun   time.Time
+	LastError string
+	Created   time.Time
+}
+
+//localQueue runs tasks in process on a bounded pool of worker goroutines
+//it stands in for Cloud Tasks when we are not running on App Engine
+//every job is recorded in the journal until it completes and a single poller
+//hands the due jobs to the workers so pending work resumes after a restart
+//and a backlog waits on disk rather than in memory
+type localQueue struct {
+	handlers map[string]taskFunc
+	jobs     chan *localJob
+	//slots holds a token for every worker busy with a job
+	slots   chan struct{}
+	journal jobJournal
+	//wake tells the poller that a job was added to the journal
+	wake chan struct{}
+
+	mu sync.Mutex
+	//claimed are the IDs of the jobs handed to the workers that have not finished yet
+	claimed map[uint64]bool
+}
+
+func newLocalQueue(handlers map[string]taskFunc, workers int, journal jobJournal) (*localQueue, error) {
+	if workers < 1 {
+		workers = 4
+	}
+	q := &localQueue{
+		handlers: handlers,
+		jobs:     make(chan *localJob, workers),
+		slots:    make(chan struct{}, workers),
+		journal:  journal,
+		wake:     make(chan struct{}, 1),
+		claimed:  make(map[uint64]bool),
+	}
+	pending, err := journal.Pending()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		log.Printf("resuming %d pending tasks", len(pending))
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	go q.poll()
+	return q, nil
+}
+
+//Dispatch implements TaskDispatcher
+//the job is safe once it is in the journal, the poller runs it as soon as a worker is free
+func (q *localQueue) Dispatch(ctx context.Context, handlerPath string, payload []byte) error {
+	if _, ok := q.handlers[handlerPath]; !ok {
+		return fmt.Errorf("no task handler for %s", handlerPath)
+	}
+	now := time.Now().UTC()
+	job := &localJob{Path: handlerPath, Payload: payload, NextRun: now, Created: now}
+	if err := q.journal.Save(job); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+//notify wakes up the poller without waiting for it
+func (q *localQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//poll hands the due jobs of the journal to the workers
+//it is the only goroutine waiting for a free worker however many jobs are pending,
+//the journal is only read once a worker is free and without the jobs still running
+//so a job is never handed out from a copy a worker has changed since
+func (q *localQueue) poll() {
+	ticker := time.NewTicker(LocalQueuePoll)
+	defer ticker.Stop()
+	for {
+		free := q.takeSlots()
+		due, err := q.journal.Due(time.Now().UTC(), free, q.isClaimed)
+		if err != nil {
+			log.Printf("trouble reading due tasks from journal: %v", err)
+		}
+		for _, job := range due {
+			q.claim(job.ID)
+			q.jobs <- job
+		}
+		for i := len(due); i < free; i++ {
+			<-q.slots
+		}
+		if len(due) > 0 && len(due) == free {
+			//there may be more waiting
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+//takeSlots waits for a free worker and returns how many are free
+func (q *localQueue) takeSlots() int {
+	q.slots <- struct{}{}
+	free := 1
+	for free < cap(q.slots) {
+		select {
+		case q.slots <- struct{}{}:
+			free++
+		default:
+			return free
+		}
+	}
+	return free
+}
+
+//claim marks a job as handed to the workers
+func (q *localQueue) claim(id uint64) {
+	q.mu.Lock()
+	q.claimed[id] = true
+	q.mu.Unlock()
+}
+
+//isClaimed reports whether a worker has the job
+func (q *localQueue) isClaimed(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.claimed[id]
+}
+
+//release lets the poller hand the job out again once it is due
+//it is only called after the outcome of the job is in the journal
+func (q *localQueue) release(id uint64) {
+	q.mu.Lock()
+	delete(q.claimed, id)
+	q.mu.Unlock()
+}
+
+func (q *localQueue) work() {
+	for job := range q.jobs {
+		q.finish(job, q.run(job))
+		q.release(job.ID)
+		<-q.slots
+	}
+}
+
+//finish records the outcome of running job in the journal
+func (q *localQueue) finish(job *localJob, err error) {
+	if err == nil {
+		if jerr := q.journal.Remove(job); jerr != nil {
+			log.Printf("trouble removing task %d from journal: %v", job.ID, jerr)
+		}
+		return
+	}
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= LocalTaskRetryLimit {
+		log.Printf("abandon task %s after %d attempts: %v", job.Path, job.Attempts, err)
+		if jerr := q.journal.Bury(job); jerr != nil {
+			log.Printf("trouble burying task %d: %v", job.ID, jerr)
+		}
+		return
+	}
+	delay := backoff(job.Attempts)
+	job.NextRun = time.Now().UTC().Add(delay)
+	log.Printf("task %s failed (attempt %d) retry in %v: %v", job.Path, job.Attempts, delay, err)
+	if jerr := q.journal.Save(job); jerr != nil {
+		log.Printf("trouble saving task %d to journal: %v", job.ID, jerr)
+	}
+}
+
+//run calls the task handler turning a panic into an error
+func (q *localQueue) run(job *localJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), LocalTaskTimeout)
+	defer cancel()
+	return q.handlers[job.Path](ctx, bytes.NewReader(job.Payload))
+}
+
+//backoff is the delay before retrying a task that failed attempts times
+func backoff(attempts int) time.Duration {
+	d := LocalTaskMinBackoff
+	for i := 1; i < attempts && d < LocalTaskMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > LocalTaskMaxBackoff {
+		d = LocalTaskMaxBackoff
+	}
+	return d
+}
+
+//JSONJob is the same as localJob but more suitable for serializing
+type JSONJob struct {
+	ID        uint64 `json:"id"`
+	Path      string `json:"path"`
+	Payload   []byte `json:"payload"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+	Created   string `json:"created"`
+}
+
+//deadJobsView answers /admin/queue/dead with the dead letter list of the local queue
+//and moves a job back to the queue on POST /admin/queue/dead/{id}/requeue
+func deadJobsView(w http.ResponseWriter, r *http.Request) {
+	q, ok := dispatcher.(*localQueue)
+	if !ok {
+		http.Error(w, "the dead letter list is only kept by the local queue", http.StatusNotFound)
+		return
+	}
+	id := getURLPart("/admin/queue/dead/", r.URL.Path, 0)
+	action := getURLPart("/admin/queue/dead/", r.URL.Path, 1)
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		dead, err := q.journal.Dead()
+		if err != nil {
+			log.Printf("Failed to list dead tasks %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list := make([]*JSONJob, 0, len(dead))
+		for _, job := range dead {
+			list = append(list, &JSONJob{
+				ID:        job.ID,
+				Path:      job.Path,
+				Payload:   job.Payload,
+				Attempts:  job.Attempts,
+				LastError: job.LastError,
+				Created:   job.Created.Format(jsLayout),
+			})
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case id != "" && action == "requeue":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		seq, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if err := q.journal.Requeue(seq); err == errNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("Failed to requeue task %s %v", id, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q.notify()
+		fmt.Fprintf(w, "OK")
+	default:
+		http.NotFound(w, r)
+	}
+}
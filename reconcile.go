@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+//ReconcileBatchSize is how many known resources a single reconcile step goes through
+const ReconcileBatchSize = 50
+
+//MaxReportedDrift is the most drifted URIs listed in a report
+const MaxReportedDrift = 100
+
+//ReconcileReport sums up a reconciliation run
+type ReconcileReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	//Checked is how many resources were looked at
+	Checked int `json:"checked"`
+	//Drifted is how many of them changed without us receiving a webhook
+	Drifted int `json:"drifted"`
+	//Failed is how many could not be fetched or stored
+	Failed int `json:"failed"`
+	//DriftedURIs lists the first MaxReportedDrift drifted resources
+	DriftedURIs []string `json:"drifted_uris" datastore:",noindex"`
+}
+
+//ReconcileArgs is the state of a reconcile run carried from one step to the next
+type ReconcileArgs struct {
+	Cursor string
+	Report ReconcileReport
+}
+
+//sampled picks the resources taking part in a run according to cfg.ReconcileSample
+func sampled() bool {
+	return cfg.ReconcileSample <= 0 || cfg.ReconcileSample >= 1 || rand.Float64() < cfg.ReconcileSample
+}
+
+//reconcileURI re-fetches uri and when it differs from the latest snapshot
+//saves a new one flagged as drift, it reports whether it did
+func reconcileURI(ctx context.Context, uri string) (bool, error) {
+	last, err := latestForURI(ctx, uri)
+	if err == errNotFound {
+		//purged since we listed it
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if last.Deleted {
+		return false, nil
+	}
+	pdata, sum, err := fetchData(ctx, apiURL(uri))
+	if err != nil {
+		return false, err
+	}
+	if sum == last.Sha1 {
+		return false, nil
+	}
+	r := Resource{
+		URI:       uri,
+		Type:      last.Type,
+		EventType: last.Type + ".reconcile",
+		Data:      pdata,
+		FetchDate: time.Now().UTC(),
+		Sha1:      sum,
+		Drift:     true,
+	}
+	if _, err := store.Put(ctx, &r); err != nil {
+		log.Printf("unable to store resource %#v", r)
+		return false, err
+	}
+	log.Printf("drift detected for %s", uri)
+	feed.publish(&r)
+	snapshotChanged(ctx, last, &r)
+	return true, nil
+}
+
+//reconcileStep goes through the next ReconcileBatchSize known resources
+//updating the cursor and report in arg, the cursor is empty once all are done
+func reconcileStep(ctx context.Context, arg *ReconcileArgs) error {
+	uris, next, err := store.URIs(ctx, arg.Cursor, ReconcileBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, uri := range uris {
+		//snapshots kept from before the type was ignored are left alone
+		if isIgnored(uriType(uri)) || !sampled() {
+			continue
+		}
+		if arg.Report.Checked > 0 {
+			if err := waitFetchDelay(ctx); err != nil {
+				return err
+			}
+		}
+		arg.Report.Checked++
+		drifted, err := reconcileURI(ctx, uri)
+		if err != nil {
+			//one broken resource should not stop the run
+			log.Printf("reconcile failed for %s: %v", uri, err)
+			arg.Report.Failed++
+			continue
+		}
+		if drifted {
+			arg.Report.Drifted++
+			if len(arg.Report.DriftedURIs) < MaxReportedDrift {
+				arg.Report.DriftedURIs = append(arg.Report.DriftedURIs, uri)
+			}
+		}
+	}
+	arg.Cursor = next
+	return nil
+}
+
+//finishReconcile logs and keeps the report of a finished run
+func finishReconcile(ctx context.Context, report *ReconcileReport) error {
+	report.Finished = time.Now().UTC()
+	log.Printf("reconcile done: %d checked, %d drifted, %d failed", report.Checked, report.Drifted, report.Failed)
+	return reconcileLog.PutReport(ctx, report)
+}
+
+//reconcile runs a whole reconciliation in the current goroutine
+func reconcile(ctx context.Context) (*ReconcileReport, error) {
+	arg := ReconcileArgs{Report: ReconcileReport{Started: time.Now().UTC()}}
+	for {
+		if err := reconcileStep(ctx, &arg); err != nil {
+			return nil, err
+		}
+		if arg.Cursor == "" {
+			break
+		}
+	}
+	return &arg.Report, finishReconcile(ctx, &arg.Report)
+}
+
+func reconcileTask(ctx context.Context, body io.Reader) error {
+	var arg ReconcileArgs
+	if err := json.NewDecoder(body).Decode(&arg); err != nil {
+		log.Printf("trouble reading request body: %v", err)
+		return err
+	}
+	if err := reconcileStep(ctx, &arg); err != nil {
+		log.Printf("trouble reconciling from %q: %v", arg.Cursor, err)
+		return err
+	}
+	if arg.Cursor != "" {
+		reconcileStepLater(ctx, arg)
+		return nil
+	}
+	return finishReconcile(ctx, &arg.Report)
+}
+
+//startReconcileLater schedules a new reconcile run
+func startReconcileLater(ctx context.Context) {
+	reconcileStepLater(ctx, ReconcileArgs{Report: ReconcileReport{Started: time.Now().UTC()}})
+}
+
+func reconcileCronView(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	startReconcileLater(r.Context())
+	w.Header().Add("content-type", "application/json")
+	fmt.Fprintf(w, "\"OK\"")
+}
+
+//reconcileView lists the latest reconcile reports and starts a new run on POST
+func reconcileView(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		reports, err := reconcileLog.Reports(r.Context(), 20)
+		if err != nil {
+			log.Printf("Failed to query reconcile reports %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if reports == nil {
+			reports = []*ReconcileReport{}
+		}
+		w.Header().Add("content-type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+	case http.MethodPost:
+		startReconcileLater(r.Context())
+		fmt.Fprintf(w, "OK")
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//DefaultRetentionDays is how long snapshots are kept when no rule says otherwise
+const DefaultRetentionDays = 31
+
+//PurgeBatchSize is how many resources a single purge step goes through
+const PurgeBatchSize = 100
+
+//RetentionRule says which snapshots of a resource type the daily purge keeps
+type RetentionRule struct {
+	//Days is how many days snapshots are kept, DefaultRetentionDays when 0 and forever when negative
+	Days int
+	//KeepLatest is how many of the newest snapshots of every resource are kept whatever their age
+	KeepLatest int
+	//KeepFirst keeps the first snapshot of every resource forever
+	KeepFirst bool
+}
+
+//retentionFor returns the rule for restype falling back to the "*" rule
+func retentionFor(restype string) RetentionRule {
+	if rule, ok := cfg.Retention[restype]; ok {
+		return rule
+	}
+	return cfg.Retention["*"]
+}
+
+//cutoff returns the time before which snapshots may be purged, zero when they are kept forever
+func (rule RetentionRule) cutoff(now time.Time) time.Time {
+	switch {
+	case rule.Days < 0:
+		return time.Time{}
+	case rule.Days == 0:
+		return now.AddDate(0, 0, -DefaultRetentionDays)
+	default:
+		return now.AddDate(0, 0, -rule.Days)
+	}
+}
+
+//expiredSnapshots returns the keys of the snapshots of uri that the retention rule of its type
+//lets us purge, the latest snapshot and snapshots holding the data of kept "seen again" markers
+//are always kept, only the snapshot metadata is read
+func expiredSnapshots(ctx context.Context, uri string, now time.Time) ([]string, error) {
+	snapshots, err := store.Snapshots(ctx, uri)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+	var (
+		rule    = retentionFor(uriType(uri))
+		cutoff  = rule.cutoff(now)
+		kept    = make(map[string]bool)
+		expired []string
+	)
+	for n, res := range snapshots {
+		//the latest snapshot is the last known state so it always stays
+		if n == 0 || n < rule.KeepLatest || cutoff.IsZero() || !res.FetchDate.Before(cutoff) {
+			kept[res.Key] = true
+			if res.Ref != "" {
+				kept[res.Ref] = true
+			}
+			continue
+		}
+		expired = append(expired, res.Key)
+	}
+	if rule.KeepFirst {
+		kept[snapshots[len(snapshots)-1].Key] = true
+	}
+	purged := expired[:0]
+	for _, key := range expired {
+		if !kept[key] {
+			purged = append(purged, key)
+		}
+	}
+	return purged, nil
+}
+
+//purgeBatches deletes the webhook batches older than cfg.HookLogDays
+func purgeBatches(ctx context.Context, now time.Time) error {
+	cutoff := RetentionRule{Days: cfg.HookLogDays}.cutoff(now)
+	if cutoff.IsZero() {
+		return nil
+	}
+	n, err := hookLog.DeleteBatches(ctx, cutoff)
+	if err != nil {
+		log.Printf("trouble purging hook batches: %v", err)
+		return err
+	}
+	log.Printf("purged %d hook batches received before %v", n, cutoff)
+	return nil
+}
+
+//purge applies the retention rules counted back from now to the next PurgeBatchSize resources
+//after cursor and schedules the next step until all resources are done
+func purge(ctx context.Context, now time.Time, cursor string) error {
+	if cursor == "" {
+		log.Printf("Starting purge with retention counted back from %v", now)
+		if err := purgeBatches(ctx, now); err != nil {
+			return err
+		}
+	}
+	uris, next, err := store.URIs(ctx, cursor, PurgeBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, uri := range uris {
+		expired, err := expiredSnapshots(ctx, uri, now)
+		if err != nil {
+			log.Printf("trouble finding expired snapshots of %s: %v", uri, err)
+			return err
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if archive != nil {
+			if err := archiveSnapshots(ctx, expired); err != nil {
+				log.Printf("trouble archiving snapshots of %s: %v", uri, err)
+				return err
+			}
+		}
+		if err := store.Delete(ctx, expired); err != nil {
+			log.Printf("trouble purging snapshots of %s: %v", uri, err)
+			return err
+		}
+	}
+	if next != "" {
+		purgeStepLater(ctx, now, next)
+	}
+	return nil
+}
@@ -4991,11 +4991,6 @@ var author$project$Main$resourceList = _List_fromArray(
 		_Utils_Tuple2('transport_dossiers', 'Transport Dossiers'),
 		_Utils_Tuple2('transports', 'Transports')
 	]);
-var elm$core$Platform$Sub$batch = _Platform_batch;
-var elm$core$Platform$Sub$none = elm$core$Platform$Sub$batch(_List_Nil);
-var author$project$Main$subscriptions = function (model) {
-	return elm$core$Platform$Sub$none;
-};
 var elm$core$Basics$neq = _Utils_notEqual;
 var elm$core$List$foldrHelper = F4(
 	function (fn, acc, ctr, ls) {
@@ -5153,17 +5148,22 @@ var elm$core$List$head = function (list) {
 	}
 };
 var author$project$Main$firstResId = function (entries) {
-	var _n0 = elm$core$List$head(entries);
-	if (_n0.$ === 1) {
-		return elm$core$Maybe$Nothing;
-	} else {
-		var entry = _n0.a;
-		var _n1 = A2(author$project$Generic$field, 'id', entry.az);
-		if (!_n1.$) {
-			var v = _n1.a;
-			return author$project$Generic$toString(v);
-		} else {
+	firstResId:
+	while (true) {
+		if (!entries.b) {
 			return elm$core$Maybe$Nothing;
+		} else {
+			var entry = entries.a;
+			var rest = entries.b;
+			var _n1 = A2(author$project$Generic$field, 'id', entry.az);
+			if (!_n1.$) {
+				var v = _n1.a;
+				return author$project$Generic$toString(v);
+			} else {
+				var $temp$entries = rest;
+				entries = $temp$entries;
+				continue firstResId;
+			}
 		}
 	}
 };
@@ -5180,9 +5180,9 @@ var NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$required = F3(
 			A2(elm$json$Json$Decode$field, key, valDecoder),
 			decoder);
 	});
-var author$project$Entry$Model = F4(
-	function (fetchdate, hookdate, sha1, resource) {
-		return {af: fetchdate, ah: hookdate, az: resource, aB: sha1};
+var author$project$Entry$Model = F7(
+	function (fetchdate, hookdate, eventType, sha1, deleted, drift, resource) {
+		return {ba: deleted, bc: drift, bb: eventType, af: fetchdate, ah: hookdate, az: resource, aB: sha1};
 	});
 var author$project$Generic$Dct = function (a) {
 	return {$: 4, a: a};
@@ -5419,23 +5419,91 @@ var author$project$Generic$lstDecoder = author$project$Generic$cyclic$lstDecoder
 author$project$Generic$cyclic$lstDecoder = function () {
 	return author$project$Generic$lstDecoder;
 };
+var elm$json$Json$Decode$decodeValue = _Json_run;
+var elm$json$Json$Decode$fail = _Json_fail;
+var elm$json$Json$Decode$value = _Json_decodeValue;
+var author$project$Main$Live = function (a) {
+	return {$: 9, a: a};
+};
+var author$project$Main$snapshot = _Platform_incomingPort('snapshot', elm$json$Json$Decode$value);
+var author$project$Main$subscriptions = function (model) {
+	return author$project$Main$snapshot(author$project$Main$Live);
+};
+var NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$optionalDecoder = F3(
+	function (pathDecoder, valDecoder, fallback) {
+		var nullOr = function (decoder) {
+			return elm$json$Json$Decode$oneOf(
+				_List_fromArray(
+					[
+						decoder,
+						elm$json$Json$Decode$null(fallback)
+					]));
+		};
+		var handleResult = function (input) {
+			var _n0 = A2(elm$json$Json$Decode$decodeValue, pathDecoder, input);
+			if (!_n0.$) {
+				var rawValue = _n0.a;
+				var _n1 = A2(
+					elm$json$Json$Decode$decodeValue,
+					nullOr(valDecoder),
+					rawValue);
+				if (!_n1.$) {
+					var finalResult = _n1.a;
+					return elm$json$Json$Decode$succeed(finalResult);
+				} else {
+					var finalErr = _n1.a;
+					return elm$json$Json$Decode$fail(
+						elm$json$Json$Decode$errorToString(finalErr));
+				}
+			} else {
+				return elm$json$Json$Decode$succeed(fallback);
+			}
+		};
+		return A2(elm$json$Json$Decode$andThen, handleResult, elm$json$Json$Decode$value);
+	});
+var NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$optional = F4(
+	function (key, valDecoder, fallback, decoder) {
+		return A2(
+			NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$custom,
+			A3(
+				NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$optionalDecoder,
+				A2(elm$json$Json$Decode$field, key, elm$json$Json$Decode$value),
+				valDecoder,
+				fallback),
+			decoder);
+	});
 var author$project$Entry$decode = A3(
 	NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$required,
 	'resource',
 	author$project$Generic$fromJson,
-	A3(
-		NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$required,
-		'sha1',
-		elm$json$Json$Decode$string,
+	A4(
+		NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$optional,
+		'drift',
+		elm$json$Json$Decode$bool,
+		false,
+		A4(
+		NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$optional,
+		'deleted',
+		elm$json$Json$Decode$bool,
+		false,
 		A3(
 			NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$required,
-			'hookdate',
+			'sha1',
 			elm$json$Json$Decode$string,
-			A3(
-				NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$required,
-				'fetchdate',
+			A4(
+				NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$optional,
+				'event_type',
 				elm$json$Json$Decode$string,
-				elm$json$Json$Decode$succeed(author$project$Entry$Model)))));
+				'',
+				A3(
+					NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$required,
+					'hookdate',
+					elm$json$Json$Decode$string,
+					A3(
+						NoRedInk$elm_json_decode_pipeline$Json$Decode$Pipeline$required,
+						'fetchdate',
+						elm$json$Json$Decode$string,
+						elm$json$Json$Decode$succeed(author$project$Entry$Model))))))));
 var author$project$Main$decodeData = elm$json$Json$Decode$list(author$project$Entry$decode);
 var elm$core$Result$mapError = F2(
 	function (f, result) {
@@ -6198,6 +6266,20 @@ var author$project$Main$updateNoOp = function (model) {
 	return _Utils_Tuple2(model, elm$core$Platform$Cmd$none);
 };
 var elm$core$String$toInt = _String_toInt;
+var elm$json$Json$Encode$string = _Json_wrap;
+var author$project$Main$listen = _Platform_outgoingPort('listen', elm$json$Json$Encode$string);
+
+
+function _Url_percentEncode(string)
+{
+	return encodeURIComponent(string);
+}
+var elm$url$Url$percentEncode = _Url_percentEncode;
+var author$project$Main$listenTo = F2(
+	function (resType, resId) {
+		return (resId === '') ? author$project$Main$listen('') : author$project$Main$listen(
+			'/live?type=' + (elm$url$Url$percentEncode(resType) + ('&id=' + elm$url$Url$percentEncode(resId))));
+	});
 var author$project$Main$update = F2(
 	function (msg, model) {
 		switch (msg.$) {
@@ -6249,6 +6331,30 @@ var author$project$Main$update = F2(
 			case 8:
 				var emsg = msg.a;
 				return author$project$Main$updateNoOp(model);
+			case 9:
+				var value = msg.a;
+				var _n1 = A2(elm$json$Json$Decode$decodeValue, author$project$Entry$decode, value);
+				if (!_n1.$) {
+					var entry = _n1.a;
+					return _Utils_Tuple2(
+						_Utils_update(
+							model,
+							{
+								J: elm$core$Maybe$Just(entry),
+								K: A2(elm$core$List$cons, entry, model.K),
+								x: 'New version received ' + entry.af
+							}),
+						elm$core$Platform$Cmd$none);
+				} else {
+					var error = _n1.a;
+					return _Utils_Tuple2(
+						_Utils_update(
+							model,
+							{
+								m: elm$json$Json$Decode$errorToString(error)
+							}),
+						elm$core$Platform$Cmd$none);
+				}
 			default:
 				var res = msg.a;
 				if (!res.$) {
@@ -6282,7 +6388,7 @@ var author$project$Main$update = F2(
 								x: elm$core$String$fromInt(
 									elm$core$List$length(entries)) + (' results found for ' + (model.l + ('/' + model.o)))
 							}),
-						elm$core$Platform$Cmd$none);
+						A2(author$project$Main$listenTo, model.l, resId));
 				} else {
 					var error = res.a;
 					var err = author$project$Main$errToString(error);
@@ -6307,7 +6413,6 @@ var elm$virtual_dom$VirtualDom$toHandlerInt = function (handler) {
 	}
 };
 var elm$html$Html$span = _VirtualDom_node('span');
-var elm$json$Json$Encode$string = _Json_wrap;
 var elm$html$Html$Attributes$stringProperty = F2(
 	function (key, string) {
 		return A2(
@@ -6508,49 +6613,109 @@ var elm$html$Html$div = _VirtualDom_node('div');
 var author$project$Entry$render = function (model) {
 	var text = elm$html$Html$text;
 	var li = elm$html$Html$li;
-	return A2(
-		elm$html$Html$div,
-		_List_Nil,
-		_List_fromArray(
-			[
-				A2(
-				elm$html$Html$ul,
-				_List_Nil,
-				_List_fromArray(
-					[
-						A2(
-						li,
-						_List_Nil,
-						_List_fromArray(
-							[
-								text('SHA1: ' + model.aB)
-							])),
-						A2(
-						li,
-						_List_Nil,
-						_List_fromArray(
-							[
-								text('Fetch Date: ' + model.af)
-							])),
-						A2(
-						li,
-						_List_Nil,
+	if (model.ba) {
+		return A2(
+			elm$html$Html$div,
+			_List_Nil,
+			_List_fromArray(
+				[
+					A2(
+					elm$html$Html$ul,
+					_List_Nil,
+					_List_fromArray(
+						[
+							A2(
+							li,
+							_List_fromArray(
+								[
+									elm$html$Html$Attributes$class('deleted')
+								]),
+							_List_fromArray(
+								[
+									text('Deleted')
+								])),
+							A2(
+							li,
+							_List_Nil,
+							_List_fromArray(
+								[
+									text('Fetch Date: ' + model.af)
+								])),
+							A2(
+							li,
+							_List_Nil,
+							_List_fromArray(
+								[
+									text('Hook Date: ' + model.ah)
+								]))
+						]))
+				]));
+	} else {
+		return A2(
+			elm$html$Html$div,
+			_List_Nil,
+			_List_fromArray(
+				[
+					A2(
+					elm$html$Html$ul,
+					_List_Nil,
+					_Utils_ap(
 						_List_fromArray(
+						[
+							A2(
+							li,
+							_List_Nil,
+							_List_fromArray(
+								[
+									text('SHA1: ' + model.aB)
+								])),
+							A2(
+							li,
+							_List_Nil,
+							_List_fromArray(
+								[
+									text('Fetch Date: ' + model.af)
+								])),
+							A2(
+							li,
+							_List_Nil,
+							_List_fromArray(
+								[
+									text('Hook Date: ' + model.ah)
+								])),
+							A2(
+							li,
+							_List_Nil,
+							_List_fromArray(
+								[
+									text('Event: ' + model.bb)
+								]))
+						]),
+						model.bc ? _List_fromArray(
 							[
-								text('Hook Date: ' + model.ah)
-							]))
-					])),
-				A2(
-				elm$html$Html$div,
-				_List_fromArray(
-					[
-						elm$html$Html$Attributes$class('jsview')
-					]),
-				_List_fromArray(
-					[
-						author$project$Entry$renderValue(model.az)
-					]))
-			]));
+								A2(
+								li,
+								_List_fromArray(
+									[
+										elm$html$Html$Attributes$class('drift')
+									]),
+								_List_fromArray(
+									[
+										text('Drift detected')
+									]))
+							]) : _List_Nil)),
+					A2(
+					elm$html$Html$div,
+					_List_fromArray(
+						[
+							elm$html$Html$Attributes$class('jsview')
+						]),
+					_List_fromArray(
+						[
+							author$project$Entry$renderValue(model.az)
+						]))
+				]));
+	}
 };
 var author$project$HistoryView$Clicked = elm$core$Basics$identity;
 var elm$virtual_dom$VirtualDom$Normal = function (a) {
@@ -6677,12 +6842,13 @@ var author$project$Main$toSelectTuples = F2(
 			} else {
 				var hd = xs.a;
 				var tl = xs.b;
+				var label = hd.ba ? (hd.af + ' (deleted)') : hd.af;
 				var newacc = A2(
 					elm$core$List$cons,
 					_Utils_Tuple2(
 						elm$core$String$fromInt(
 							elm$core$List$length(acc)),
-						hd.af),
+						label),
 					acc);
 				var $temp$acc = newacc,
 					$temp$xs = tl;
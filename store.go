@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//ResourceStore is the persistence layer for resource snapshots
+type ResourceStore interface {
+	//Put saves a new snapshot and returns its key
+	Put(ctx context.Context, r *Resource) (string, error)
+	//Get returns the snapshot saved under key
+	Get(ctx context.Context, key string) (*Resource, error)
+	//Query returns snapshots matching q ordered newest first unless q.Ascending is set
+	Query(ctx context.Context, q ResourceQuery) ResourceIterator
+	//LatestByType returns the most recently fetched snapshot of a resource type
+	LatestByType(ctx context.Context, restype string) (*Resource, error)
+	//Delete removes the snapshots saved under keys, keys that do not exist are ignored
+	Delete(ctx context.Context, keys []string) error
+	//Snapshots returns every snapshot of uri newest first with only URI, Key, FetchDate and Ref set
+	//so the purge can sort them out without reading their data
+	Snapshots(ctx context.Context, uri string) ([]Resource, error)
+	//URIs returns up to limit distinct resource URIs in order starting after cursor
+	//and the cursor to the next page which is empty after the last one
+	URIs(ctx context.Context, cursor string, limit int) ([]string, string, error)
+}
+
+//ResourceQuery selects snapshots of a single resource
+type ResourceQuery struct {
+	URI string
+	//Since limits the results to snapshots fetched at or after it when set
+	Since time.Time
+	//Until limits the results to snapshots fetched at or before it when set
+	Until time.Time
+	//EventType limits the results to snapshots saved for this webhook event type when set
+	EventType string
+	//Ascending returns the oldest snapshots first
+	Ascending bool
+	//Limit is the most results to return when set
+	Limit int
+	//Cursor continues a previous query from the position returned by ResourceIterator.Cursor
+	Cursor string
+}
+
+//ResourceIterator walks the results of a query
+//Next returns iterator.Done once there are no more results
+type ResourceIterator interface {
+	Next(r *Resource) error
+	//Cursor returns the position after the last result returned by Next
+	Cursor() (string, error)
+}
+
+//HookLog keeps every webhook batch we receive
+type HookLog interface {
+	//PutBatch saves a received batch and returns its key
+	PutBatch(ctx context.Context, b *HookBatch) (string, error)
+	//GetBatch returns the batch saved under key
+	GetBatch(ctx context.Context, key string) (*HookBatch, error)
+	//QueryBatches returns batches matching q newest first and a cursor to the next page
+	QueryBatches(ctx context.Context, q BatchQuery) ([]*HookBatch, string, error)
+	//DeleteBatches removes the batches received before t and returns how many there were
+	DeleteBatches(ctx context.Context, t time.Time) (int, error)
+}
+
+//BatchQuery selects received webhook batches
+type BatchQuery struct {
+	//Resource limits the results to batches with events for this resource type when set
+	Resource string
+	//EventType limits the results to batches with events of this type when set
+	EventType string
+	Since     time.Time
+	Until     time.Time
+	//Limit is the most results to return, all of them when 0
+	Limit  int
+	Cursor string
+}
+
+//ReconcileLog keeps the reports of reconciliation runs
+type ReconcileLog interface {
+	//PutReport saves the report of a finished run
+	PutReport(ctx context.Context, r *ReconcileReport) error
+	//Reports returns up to limit reports newest first
+	Reports(ctx context.Context, limit int) ([]*ReconcileReport, error)
+}
+
+//AlertLog keeps the alerts raised by watch rules
+type AlertLog interface {
+	//PutAlert saves an alert and returns its key
+	PutAlert(ctx context.Context, a *Alert) (string, error)
+	//QueryAlerts returns alerts matching q newest first and a cursor to the next page
+	QueryAlerts(ctx context.Context, q AlertQuery) ([]*Alert, string, error)
+}
+
+//AlertQuery selects alerts
+type AlertQuery struct {
+	//Rule limits the results to alerts raised by the rule of this name when set
+	Rule string
+	//Limit is the most results to return, all of them when 0
+	Limit  int
+	Cursor string
+}
+
+//KeyStore keeps the API keys issued to clients
+type KeyStore interface {
+	//PutKey saves k under k.ID
+	PutKey(ctx context.Context, k *APIKey) error
+	//GetKey returns the key saved under id
+	GetKey(ctx context.Context, id string) (*APIKey, error)
+	//Keys returns all keys newest first
+	Keys(ctx context.Context) ([]*APIKey, error)
+}
+
+//Backend is everything res-log persists
+type Backend interface {
+	ResourceStore
+	HookLog
+	ReconcileLog
+	AlertLog
+	KeyStore
+}
+
+//errNotFound is returned when a lookup has no results
+var errNotFound = fmt.Errorf("resource not found")
+
+//errBadCursor is returned by ResourceIterator.Next when the query cursor is not one we handed out
+var errBadCursor = fmt.Errorf("invalid cursor")
+
+//the backend used by the handlers, set up by openStore
+var (
+	store        ResourceStore
+	hookLog      HookLog
+	reconcileLog ReconcileLog
+	alertLog     AlertLog
+	keyStore     KeyStore
+)
+
+func openStore(ctx context.Context) (Backend, error) {
+	switch cfg.Store {
+	case "", "datastore":
+		return newDatastoreStore(ctx)
+	case "bolt":
+		path := cfg.StorePath
+		if path == "" {
+			path = "res-log.db"
+		}
+		return newBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/api/iterator"
+)
+
+//bucket names used by boltStore
+var (
+	bktResources = []byte("resource")
+	bktByURI     = []byte("resource_uri")
+	bktByType    = []byte("resource_type")
+	bktBatches   = []byte("hook_batch")
+	bktReports   = []byte("reconcile_report")
+	bktAlerts    = []byte("alert")
+	bktKeys      = []byte("api_key")
+	bktMeta      = []byte("meta")
+)
+
+//keyIndexRefs notes in bktMeta that the uri index carries the Ref of every snapshot
+var keyIndexRefs = []byte("uri_index_refs")
+
+//boltStore keeps resources in a local BoltDB file
+//every resource is stored under a sequence id and indexed by
+//uri and type so we can answer the same queries as Datastore,
+//the uri index entries hold the Ref of the snapshot so the purge can skip the data
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bktResources, bktByURI, bktByType, bktBatches, bktReports, bktAlerts, bktKeys, bktMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return indexRefs(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db}, nil
+}
+
+//indexRefs copies the Ref of snapshots saved before the uri index held it into their index entries
+//it only runs once per database
+func indexRefs(tx *bolt.Tx) error {
+	meta := tx.Bucket(bktMeta)
+	if meta.Get(keyIndexRefs) != nil {
+		return nil
+	}
+	index := tx.Bucket(bktByURI)
+	refs := make(map[string][]byte)
+	c := index.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		r, err := decodeResource(tx.Bucket(bktResources).Get(k[len(k)-8:]))
+		if err != nil {
+			return err
+		}
+		if r.Ref != "" {
+			refs[string(k)] = []byte(r.Ref)
+		}
+	}
+	//the cursor is done so the bucket can be changed
+	for k, ref := range refs {
+		if err := index.Put([]byte(k), ref); err != nil {
+			return err
+		}
+	}
+	return meta.Put(keyIndexRefs, []byte{1})
+}
+
+//Close releases the underlying database file
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+//Put implements ResourceStore
+func (s *boltStore) Put(ctx context.Context, r *Resource) (string, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktResources)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		id := encodeUint(seq)
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+			return err
+		}
+		if err := b.Put(id, buf.Bytes()); err != nil {
+			return err
+		}
+		stamp := encodeTime(r.FetchDate)
+		if err := tx.Bucket(bktByURI).Put(indexKey(r.URI, stamp, id), []byte(r.Ref)); err != nil {
+			return err
+		}
+		r.Key = strconv.FormatUint(seq, 10)
+		return tx.Bucket(bktByType).Put(indexKey(r.Type, stamp, id), nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	return r.Key, nil
+}
+
+//Get implements ResourceStore
+func (s *boltStore) Get(ctx context.Context, key string) (*Resource, error) {
+	seq, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, errNotFound
+	}
+	var r *Resource
+	err = s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		r, err = decodeResource(tx.Bucket(bktResources).Get(encodeUint(seq)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.Key = key
+	return r, nil
+}
+
+//Query implements ResourceStore
+func (s *boltStore) Query(ctx context.Context, q ResourceQuery) ResourceIterator {
+	it := newBoltIterator(s.db, bktByURI, q.URI)
+	if !q.Since.IsZero() {
+		it.lo = append(indexPrefix(q.URI), encodeTime(q.Since)...)
+	}
+	if !q.Until.IsZero() {
+		it.hi = append(indexPrefix(q.URI), encodeUint(uint64(q.Until.UnixNano())+1)...)
+	}
+	it.asc = q.Ascending
+	it.eventType = q.EventType
+	if q.Cursor != "" {
+		//a cursor is the index key of the last result which is the prefix, stamp and id
+		last, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if prefix := indexPrefix(q.URI); err != nil || len(last) != len(prefix)+16 || !bytes.HasPrefix(last, prefix) {
+			it.err = errBadCursor
+		}
+		it.last = last
+	}
+	return it
+}
+
+//LatestByType implements ResourceStore
+func (s *boltStore) LatestByType(ctx context.Context, restype string) (*Resource, error) {
+	var res Resource
+	t := newBoltIterator(s.db, bktByType, restype)
+	if err := t.Next(&res); err == iterator.Done {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+//Delete implements ResourceStore
+func (s *boltStore) Delete(ctx context.Context, keys []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			seq, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := s.delete(tx, encodeUint(seq)); err != nil && err != errNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//delete removes a resource and its index entries
+func (s *boltStore) delete(tx *bolt.Tx, id []byte) error {
+	b := tx.Bucket(bktResources)
+	r, err := decodeResource(b.Get(id))
+	if err != nil {
+		return err
+	}
+	stamp := encodeTime(r.FetchDate)
+	if err := tx.Bucket(bktByURI).Delete(indexKey(r.URI, stamp, id)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(bktByType).Delete(indexKey(r.Type, stamp, id)); err != nil {
+		return err
+	}
+	return b.Delete(id)
+}
+
+//Snapshots implements ResourceStore
+//everything it returns is in the uri index so the resources are never read
+func (s *boltStore) Snapshots(ctx context.Context, uri string) ([]Resource, error) {
+	var snapshots []Resource
+	prefix := indexPrefix(uri)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bktByURI).Cursor()
+		for k, v := seekBefore(c, prefixEnd(prefix)); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Prev() {
+			stamp, id := k[len(k)-16:len(k)-8], k[len(k)-8:]
+			snapshots = append(snapshots, Resource{
+				URI:       uri,
+				FetchDate: time.Unix(0, int64(binary.BigEndian.Uint64(stamp))).UTC(),
+				Ref:       string(v),
+				Key:       strconv.FormatUint(binary.BigEndian.Uint64(id), 10),
+			})
+		}
+		return nil
+	})
+	return snapshots, err
+}
+
+//URIs implements ResourceStore
+//the uri index is sorted by uri so we jump from one uri to the next
+func (s *boltStore) URIs(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	var (
+		uris []string
+		next string
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bktByURI).Cursor()
+		var k []byte
+		if cursor == "" {
+			k, _ = c.First()
+		} else {
+			k, _ = c.Seek(prefixEnd(indexPrefix(cursor)))
+		}
+		for k != nil {
+			if len(uris) == limit {
+				next = uris[len(uris)-1]
+				break
+			}
+			//strip the separator, stamp and id
+			uri := string(k[:len(k)-17])
+			uris = append(uris, uri)
+			k, _ = c.Seek(prefixEnd(indexPrefix(uri)))
+		}
+		return nil
+	})
+	return uris, next, err
+}
+
+//PutBatch implements HookLog
+func (s *boltStore) PutBatch(ctx context.Context, hb *HookBatch) (string, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktBatches)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(hb); err != nil {
+			return err
+		}
+		hb.Key = strconv.FormatUint(seq, 10)
+		return b.Put(encodeUint(seq), buf.Bytes())
+	})
+	if err != nil {
+		return "", err
+	}
+	return hb.Key, nil
+}
+
+//GetBatch implements HookLog
+func (s *boltStore) GetBatch(ctx context.Context, key string) (*HookBatch, error) {
+	seq, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return nil, errNotFound
+	}
+	var hb *HookBatch
+	err = s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		hb, err = decodeBatch(tx.Bucket(bktBatches).Get(encodeUint(seq)))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	hb.Key = key
+	return hb, nil
+}
+
+//QueryBatches implements HookLog
+//batches are kept in the order received so we walk them backwards filtering as we go
+func (s *boltStore) QueryBatches(ctx context.Context, q BatchQuery) ([]*HookBatch, string, error) {
+	var (
+		batches []*HookBatch
+		next    string
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bktBatches).Cursor()
+		var k, v []byte
+		if seq, err := strconv.ParseUint(q.Cursor, 10, 64); err == nil {
+			k, v = seekBefore(c, encodeUint(seq))
+		} else {
+			k, v = c.Last()
+		}
+		for ; k != nil; k, v = c.Prev() {
+			hb, err := decodeBatch(v)
+			if err != nil {
+				return err
+			}
+			if !q.Since.IsZero() && hb.Received.Before(q.Since) {
+				break
+			}
+			if !hb.matches(q) {
+				continue
+			}
+			if q.Limit > 0 && len(batches) == q.Limit {
+				next = batches[len(batches)-1].Key
+				break
+			}
+			hb.Key = strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+			batches = append(batches, hb)
+		}
+		return nil
+	})
+	return batches, next, err
+}
+
+//DeleteBatches implements HookLog
+//batches are kept in the order received so the old ones are at the start
+func (s *boltStore) DeleteBatches(ctx context.Context, t time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bktBatches).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			hb, err := decodeBatch(v)
+			if err != nil {
+				return err
+			}
+			if !hb.Received.Before(t) {
+				break
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func decodeBatch(data []byte) (*HookBatch, error) {
+	if data == nil {
+		return nil, errNotFound
+	}
+	var hb HookBatch
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&hb); err != nil {
+		return nil, err
+	}
+	return &hb, nil
+}
+
+//PutReport implements ReconcileLog
+func (s *boltStore) PutReport(ctx context.Context, r *ReconcileReport) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktReports)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+			return err
+		}
+		return b.Put(encodeUint(seq), buf.Bytes())
+	})
+}
+
+//Reports implements ReconcileLog
+func (s *boltStore) Reports(ctx context.Context, limit int) ([]*ReconcileReport, error) {
+	var reports []*ReconcileReport
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bktReports).Cursor()
+		for k, v := c.Last(); k != nil && len(reports) < limit; k, v = c.Prev() {
+			var r ReconcileReport
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&r); err != nil {
+				return err
+			}
+			reports = append(reports, &r)
+		}
+		return nil
+	})
+	return reports, err
+}
+
+//PutAlert implements AlertLog
+func (s *boltStore) PutAlert(ctx context.Context, a *Alert) (string, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bktAlerts)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(a); err != nil {
+			return err
+		}
+		a.Key = strconv.FormatUint(seq, 10)
+		return b.Put(encodeUint(seq), buf.Bytes())
+	})
+	if err != nil {
+		return "", err
+	}
+	return a.Key, nil
+}
+
+//QueryAlerts implements AlertLog
+func (s *boltStore) QueryAlerts(ctx context.Context, q AlertQuery) ([]*Alert, string, error) {
+	var (
+		alerts []*Alert
+		next   string
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bktAlerts).Cursor()
+		var k, v []byte
+		if seq, err := strconv.ParseUint(q.Cursor, 10, 64); err == nil {
+			k, v = seekBefore(c, encodeUint(seq))
+		} else {
+			k, v = c.Last()
+		}
+		for ; k != nil; k, v = c.Prev() {
+			var a Alert
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&a); err != nil {
+				return err
+			}
+			if q.Rule != "" && a.Rule != q.Rule {
+				continue
+			}
+			if q.Limit > 0 && len(alerts) == q.Limit {
+				next = alerts[len(alerts)-1].Key
+				break
+			}
+			a.Key = strconv.FormatUint(binary.BigEndian.Uint64(k), 10)
+			alerts = append(alerts, &a)
+		}
+		return nil
+	})
+	return alerts, next, err
+}
+
+//PutKey implements KeyStore
+func (s *boltStore) PutKey(ctx context.Context, k *APIKey) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(k); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bktKeys).Put([]byte(k.ID), buf.Bytes())
+	})
+}
+
+//GetKey implements KeyStore
+func (s *boltStore) GetKey(ctx context.Context, id string) (*APIKey, error) {
+	var k APIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bktKeys).Get([]byte(id))
+		if data == nil {
+			return errNotFound
+		}
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(&k)
+	})
+	if err != nil {
+		return nil, err
+	}
+	k.ID = id
+	return &k, nil
+}
+
+//Keys implements KeyStore
+//there are few keys so we sort them in memory
+func (s *boltStore) Keys(ctx context.Context) ([]*APIKey, error) {
+	var keys []*APIKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bktKeys).ForEach(func(id, data []byte) error {
+			var k APIKey
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&k); err != nil {
+				return err
+			}
+			k.ID = string(id)
+			keys = append(keys, &k)
+			return nil
+		})
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.After(keys[j].Created) })
+	return keys, err
+}
+
+//boltIterator walks the keys of an index bucket within [lo, hi)
+//newest first unless asc is set, resuming after last when it is set
+//and skipping resources of other event types when eventType is set
+//each call to Next uses its own read transaction so that slow consumers
+//do not keep the database locked
+type boltIterator struct {
+	db    *bolt.DB
+	index []byte
+	lo    []byte
+	hi    []byte
+	asc   bool
+	last  []byte
+	done  bool
+	//err is returned by Next when set
+	err error
+
+	eventType string
+}
+
+//newBoltIterator returns an iterator over all index keys of value
+func newBoltIterator(db *bolt.DB, index []byte, value string) *boltIterator {
+	prefix := indexPrefix(value)
+	return &boltIterator{db: db, index: index, lo: prefix, hi: prefixEnd(prefix)}
+}
+
+//Next implements ResourceIterator
+func (it *boltIterator) Next(r *Resource) error {
+	if it.err != nil {
+		return it.err
+	}
+	if it.done {
+		return iterator.Done
+	}
+	return it.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(it.index).Cursor()
+		for {
+			k := it.advance(c)
+			if k == nil || bytes.Compare(k, it.lo) < 0 || bytes.Compare(k, it.hi) >= 0 {
+				it.done = true
+				return iterator.Done
+			}
+			it.last = append([]byte(nil), k...)
+			id := k[len(k)-8:]
+			res, err := decodeResource(tx.Bucket(bktResources).Get(id))
+			if err != nil {
+				return err
+			}
+			if it.eventType != "" && res.EventType != it.eventType {
+				continue
+			}
+			*r = *res
+			r.Key = strconv.FormatUint(binary.BigEndian.Uint64(id), 10)
+			return nil
+		}
+	})
+}
+
+//advance moves the cursor to the key following last in iteration order
+func (it *boltIterator) advance(c *bolt.Cursor) []byte {
+	var k []byte
+	switch {
+	case it.asc && it.last == nil:
+		k, _ = c.Seek(it.lo)
+	case it.asc:
+		if k, _ = c.Seek(it.last); bytes.Equal(k, it.last) {
+			k, _ = c.Next()
+		}
+	case it.last == nil:
+		k, _ = seekBefore(c, it.hi)
+	default:
+		k, _ = seekBefore(c, it.last)
+	}
+	return k
+}
+
+//Cursor implements ResourceIterator
+func (it *boltIterator) Cursor() (string, error) {
+	return base64.RawURLEncoding.EncodeToString(it.last), nil
+}
+
+//seekBefore positions the cursor on the last key smaller than key
+func seekBefore(c *bolt.Cursor, key []byte) ([]byte, []byte) {
+	if k, _ := c.Seek(key); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+func decodeResource(data []byte) (*Resource, error) {
+	if data == nil {
+		return nil, errNotFound
+	}
+	var r Resource
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+//indexPrefix is the common prefix for all index keys of a value
+func indexPrefix(value string) []byte {
+	return append([]byte(value), 0)
+}
+
+//prefixEnd is the first key past all keys starting with prefix
+//prefix always ends with the 0 separator so bumping it is enough
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	end[len(end)-1]++
+	return end
+}
+
+func indexKey(value string, stamp, id []byte) []byte {
+	k := indexPrefix(value)
+	k = append(k, stamp...)
+	return append(k, id...)
+}
+
+func encodeUint(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func encodeTime(t time.Time) []byte {
+	return encodeUint(uint64(t.UnixNano()))
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+)
+
+//datastoreStore keeps resources in Cloud Datastore
+type datastoreStore struct {
+	client *datastore.Client
+}
+
+func newDatastoreStore(ctx context.Context) (*datastoreStore, error) {
+	client, err := datastore.NewClient(ctx, projectID)
+	if err != nil {
+		log.Printf("unable to create Datastore client %v", err)
+		return nil, err
+	}
+	return &datastoreStore{client}, nil
+}
+
+//Put implements ResourceStore
+func (s *datastoreStore) Put(ctx context.Context, r *Resource) (string, error) {
+	key, err := s.client.Put(ctx, datastore.IncompleteKey("resource", nil), r)
+	if err != nil {
+		return "", err
+	}
+	r.Key = key.Encode()
+	return r.Key, nil
+}
+
+//Get implements ResourceStore
+func (s *datastoreStore) Get(ctx context.Context, encKey string) (*Resource, error) {
+	key, err := datastore.DecodeKey(encKey)
+	if err != nil {
+		return nil, errNotFound
+	}
+	var r Resource
+	if err := s.client.Get(ctx, key, &r); err == datastore.ErrNoSuchEntity {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	r.Key = encKey
+	return &r, nil
+}
+
+//Query implements ResourceStore
+func (s *datastoreStore) Query(ctx context.Context, q ResourceQuery) ResourceIterator {
+	dq := datastore.NewQuery("resource").Filter("Uri =", q.URI)
+	if q.Ascending {
+		dq = dq.Order("FetchDate")
+	} else {
+		dq = dq.Order("-FetchDate")
+	}
+	if q.EventType != "" {
+		dq = dq.Filter("EventType =", q.EventType)
+	}
+	if !q.Since.IsZero() {
+		dq = dq.Filter("FetchDate >=", q.Since)
+	}
+	if !q.Until.IsZero() {
+		dq = dq.Filter("FetchDate <=", q.Until)
+	}
+	if q.Limit > 0 {
+		//one more so callers can tell whether there is a next page
+		dq = dq.Limit(q.Limit + 1)
+	}
+	if q.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(q.Cursor)
+		if err != nil {
+			return &datastoreIterator{err: errBadCursor}
+		}
+		dq = dq.Start(cursor)
+	}
+	return &datastoreIterator{t: s.client.Run(ctx, dq)}
+}
+
+//LatestByType implements ResourceStore
+func (s *datastoreStore) LatestByType(ctx context.Context, restype string) (*Resource, error) {
+	q := datastore.NewQuery("resource").
+		Filter("Type =", restype).
+		Order("-FetchDate").
+		Limit(1)
+	var resources []Resource
+	keys, err := s.client.GetAll(ctx, q, &resources)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errNotFound
+	}
+	resources[0].Key = keys[0].Encode()
+	return &resources[0], nil
+}
+
+//maxDeleteMulti is the most keys Datastore deletes in one call
+const maxDeleteMulti = 500
+
+//maxGetMulti is the most entities Datastore loads in one call
+const maxGetMulti = 1000
+
+//Delete implements ResourceStore
+func (s *datastoreStore) Delete(ctx context.Context, encKeys []string) error {
+	var keys []*datastore.Key
+	for _, encKey := range encKeys {
+		if key, err := datastore.DecodeKey(encKey); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteMulti {
+			n = maxDeleteMulti
+		}
+		if err := s.client.DeleteMulti(ctx, keys[:n]); err != nil {
+			log.Printf("trouble with multi delete: %v", err)
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+//datastoreIterator adapts datastore.Iterator to ResourceIterator
+//err is returned instead when the query could not be run
+type datastoreIterator struct {
+	t   *datastore.Iterator
+	err error
+}
+
+//Next implements ResourceIterator
+func (it *datastoreIterator) Next(r *Resource) error {
+	if it.err != nil {
+		return it.err
+	}
+	key, err := it.t.Next(r)
+	if err != nil {
+		return err
+	}
+	r.Key = key.Encode()
+	return nil
+}
+
+//Cursor implements ResourceIterator
+func (it *datastoreIterator) Cursor() (string, error) {
+	if it.err != nil {
+		return "", it.err
+	}
+	cursor, err := it.t.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return cursor.String(), nil
+}
+
+//PutBatch implements HookLog
+func (s *datastoreStore) PutBatch(ctx context.Context, b *HookBatch) (string, error) {
+	key, err := s.client.Put(ctx, datastore.IncompleteKey("hook_batch", nil), b)
+	if err != nil {
+		return "", err
+	}
+	b.Key = key.Encode()
+	return b.Key, nil
+}
+
+//GetBatch implements HookLog
+func (s *datastoreStore) GetBatch(ctx context.Context, encKey string) (*HookBatch, error) {
+	key, err := datastore.DecodeKey(encKey)
+	if err != nil {
+		return nil, errNotFound
+	}
+	var b HookBatch
+	if err := s.client.Get(ctx, key, &b); err == datastore.ErrNoSuchEntity {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	b.Key = encKey
+	return &b, nil
+}
+
+//QueryBatches implements HookLog
+func (s *datastoreStore) QueryBatches(ctx context.Context, q BatchQuery) ([]*HookBatch, string, error) {
+	dq := datastore.NewQuery("hook_batch").Order("-Received")
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit + 1)
+	}
+	if q.Resource != "" {
+		dq = dq.Filter("Resources =", q.Resource)
+	}
+	if q.EventType != "" {
+		dq = dq.Filter("EventTypes =", q.EventType)
+	}
+	if !q.Since.IsZero() {
+		dq = dq.Filter("Received >=", q.Since)
+	}
+	if !q.Until.IsZero() {
+		dq = dq.Filter("Received <=", q.Until)
+	}
+	if q.Cursor != "" {
+		if cursor, err := datastore.DecodeCursor(q.Cursor); err == nil {
+			dq = dq.Start(cursor)
+		}
+	}
+	var (
+		batches []*HookBatch
+		next    string
+	)
+	t := s.client.Run(ctx, dq)
+	for {
+		var b HookBatch
+		key, err := t.Next(&b)
+		if err == iterator.Done {
+			next = ""
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		if q.Limit > 0 && len(batches) == q.Limit {
+			break
+		}
+		b.Key = key.Encode()
+		batches = append(batches, &b)
+		cursor, err := t.Cursor()
+		if err != nil {
+			return nil, "", err
+		}
+		next = cursor.String()
+	}
+	return batches, next, nil
+}
+
+//DeleteBatches implements HookLog
+//the query is keys only so the bodies are never read
+func (s *datastoreStore) DeleteBatches(ctx context.Context, t time.Time) (int, error) {
+	n := 0
+	for {
+		q := datastore.NewQuery("hook_batch").Filter("Received <", t).KeysOnly().Limit(maxDeleteMulti)
+		keys, err := s.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return n, err
+		}
+		if len(keys) == 0 {
+			return n, nil
+		}
+		if err := s.client.DeleteMulti(ctx, keys); err != nil {
+			log.Printf("trouble with multi delete: %v", err)
+			return n, err
+		}
+		n += len(keys)
+	}
+}
+
+//Snapshots implements ResourceStore
+//the projection never reads the data, snapshots saved before Ref was indexed
+//are missing from it so the purge keeps them
+func (s *datastoreStore) Snapshots(ctx context.Context, uri string) ([]Resource, error) {
+	q := datastore.NewQuery("resource").
+		Filter("Uri =", uri).
+		Order("-FetchDate").
+		Project("FetchDate", "Ref")
+	var snapshots []Resource
+	keys, err := s.client.GetAll(ctx, q, &snapshots)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		snapshots[i].URI = uri
+		snapshots[i].Key = key.Encode()
+		seen[snapshots[i].Key] = true
+	}
+	//snapshots saved before Ref was indexed are left out of the projection
+	//so they are found by key and loaded in full
+	all, err := s.client.GetAll(ctx, datastore.NewQuery("resource").Filter("Uri =", uri).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var missing []*datastore.Key
+	for _, key := range all {
+		if !seen[key.Encode()] {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return snapshots, nil
+	}
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > maxGetMulti {
+			n = maxGetMulti
+		}
+		old := make([]Resource, n)
+		if err := s.client.GetMulti(ctx, missing[:n], old); err != nil {
+			return nil, err
+		}
+		for i := range old {
+			snapshots = append(snapshots, Resource{URI: uri, Key: missing[i].Encode(), FetchDate: old[i].FetchDate, Ref: old[i].Ref})
+		}
+		missing = missing[n:]
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].FetchDate.After(snapshots[j].FetchDate) })
+	return snapshots, nil
+}
+
+//URIs implements ResourceStore
+func (s *datastoreStore) URIs(ctx context.Context, encCursor string, limit int) ([]string, string, error) {
+	q := datastore.NewQuery("resource").Project("Uri").DistinctOn("Uri").Order("Uri").Limit(limit)
+	if encCursor != "" {
+		if cursor, err := datastore.DecodeCursor(encCursor); err == nil {
+			q = q.Start(cursor)
+		}
+	}
+	var uris []string
+	t := s.client.Run(ctx, q)
+	for {
+		var r Resource
+		if _, err := t.Next(&r); err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		uris = append(uris, r.URI)
+	}
+	if len(uris) < limit {
+		return uris, "", nil
+	}
+	cursor, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return uris, cursor.String(), nil
+}
+
+//PutReport implements ReconcileLog
+func (s *datastoreStore) PutReport(ctx context.Context, r *ReconcileReport) error {
+	_, err := s.client.Put(ctx, datastore.IncompleteKey("reconcile_report", nil), r)
+	return err
+}
+
+//Reports implements ReconcileLog
+func (s *datastoreStore) Reports(ctx context.Context, limit int) ([]*ReconcileReport, error) {
+	q := datastore.NewQuery("reconcile_report").Order("-Started").Limit(limit)
+	var reports []*ReconcileReport
+	if _, err := s.client.GetAll(ctx, q, &reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+//PutAlert implements AlertLog
+func (s *datastoreStore) PutAlert(ctx context.Context, a *Alert) (string, error) {
+	key, err := s.client.Put(ctx, datastore.IncompleteKey("alert", nil), a)
+	if err != nil {
+		return "", err
+	}
+	a.Key = key.Encode()
+	return a.Key, nil
+}
+
+//QueryAlerts implements AlertLog
+func (s *datastoreStore) QueryAlerts(ctx context.Context, q AlertQuery) ([]*Alert, string, error) {
+	dq := datastore.NewQuery("alert").Order("-Created")
+	if q.Limit > 0 {
+		dq = dq.Limit(q.Limit + 1)
+	}
+	if q.Rule != "" {
+		dq = dq.Filter("Rule =", q.Rule)
+	}
+	if q.Cursor != "" {
+		if cursor, err := datastore.DecodeCursor(q.Cursor); err == nil {
+			dq = dq.Start(cursor)
+		}
+	}
+	var (
+		alerts []*Alert
+		next   string
+	)
+	t := s.client.Run(ctx, dq)
+	for {
+		var a Alert
+		key, err := t.Next(&a)
+		if err == iterator.Done {
+			next = ""
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		if q.Limit > 0 && len(alerts) == q.Limit {
+			break
+		}
+		a.Key = key.Encode()
+		alerts = append(alerts, &a)
+		cursor, err := t.Cursor()
+		if err != nil {
+			return nil, "", err
+		}
+		next = cursor.String()
+	}
+	return alerts, next, nil
+}
+
+//PutKey implements KeyStore
+func (s *datastoreStore) PutKey(ctx context.Context, k *APIKey) error {
+	_, err := s.client.Put(ctx, datastore.NameKey("api_key", k.ID, nil), k)
+	return err
+}
+
+//GetKey implements KeyStore
+func (s *datastoreStore) GetKey(ctx context.Context, id string) (*APIKey, error) {
+	var k APIKey
+	if err := s.client.Get(ctx, datastore.NameKey("api_key", id, nil), &k); err == datastore.ErrNoSuchEntity {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	k.ID = id
+	return &k, nil
+}
+
+//Keys implements KeyStore
+func (s *datastoreStore) Keys(ctx context.Context) ([]*APIKey, error) {
+	var keys []*APIKey
+	dskeys, err := s.client.GetAll(ctx, datastore.NewQuery("api_key").Order("-Created"), &keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range dskeys {
+		keys[i].ID = key.Name
+	}
+	return keys, nil
+}
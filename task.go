@@ -1,16 +1,41 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"time"
 )
 
+//taskFunc does the work of a single task given its payload
+type taskFunc func(ctx context.Context, body io.Reader) error
+
+//taskFuncs maps the handler path of every task to the function doing the work
+var taskFuncs = map[string]taskFunc{
+	"/task/process_hook":  processHook,
+	"/task/save_resource": saveResourceTask,
+	"/task/purge_before":  purgeTask,
+	"/task/purge_step":    purgeStepTask,
+	"/task/backfill":      backfillTask,
+	"/task/reconcile":     reconcileTask,
+	"/task/restore":       restoreTask,
+	"/task/notify":        notifyTask,
+	"/task/alert":         alertTask,
+}
+
 //this decorator ensures we are called in decorator mode
 func authDecor(next http.Handler) http.Handler {
 	closure := func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := dispatcher.(*cloudTasksDispatcher); !ok {
+			// outside of App Engine anybody can set X-Appengine-Taskname
+			// and tasks are run in process anyway
+			log.Println("Invalid Task: tasks are not dispatched by Cloud Tasks")
+			http.Error(w, "Bad Request - Invalid Task", http.StatusBadRequest)
+			return
+		}
 		t, ok := r.Header["X-Appengine-Taskname"]
 		if !ok || len(t[0]) == 0 {
 			// You may use the presence of the X-Appengine-Taskname header to validate
@@ -24,60 +49,57 @@ func authDecor(next http.Handler) http.Handler {
 	return http.HandlerFunc(closure)
 }
 
-func processHookView(w http.ResponseWriter, r *http.Request) {
-	if err := processHook(r.Context(), r.Body); err != nil {
-		log.Printf("Trouble %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+//taskView exposes a taskFunc as the http handler Cloud Tasks calls
+func taskView(fn taskFunc) http.Handler {
+	closure := func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(r.Context(), r.Body); err != nil {
+			log.Printf("Trouble %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "OK")
 	}
-	fmt.Fprintf(w, "OK")
+	return http.HandlerFunc(closure)
 }
 
-func saveResourceView(w http.ResponseWriter, r *http.Request) {
+func saveResourceTask(ctx context.Context, body io.Reader) error {
 	var hook hookStruct
-	err := json.NewDecoder(r.Body).Decode(&hook)
+	err := json.NewDecoder(body).Decode(&hook)
 	if err != nil {
 		log.Printf("trouble decoding %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	if err := saveResource(r.Context(), &hook); err != nil {
+	if err := saveResource(ctx, &hook); err != nil {
 		log.Printf("trouble saving %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	fmt.Fprintf(w, "OK")
+	return nil
 }
 
-func purgeBeforeView(w http.ResponseWriter, r *http.Request) {
+func purgeTask(ctx context.Context, body io.Reader) error {
 	var t time.Time
-	err := json.NewDecoder(r.Body).Decode(&t)
+	err := json.NewDecoder(body).Decode(&t)
 	if err != nil {
 		log.Printf("trouble decoding %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	if err := purgeBefore(r.Context(), t, ""); err != nil {
+	if err := purge(ctx, t, ""); err != nil {
 		log.Printf("trouble purging with time %v: %v", t, err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	fmt.Fprintf(w, "OK")
-
+	return nil
 }
 
-func purgeStepView(w http.ResponseWriter, r *http.Request) {
+func purgeStepTask(ctx context.Context, body io.Reader) error {
 	var arg LaterStepArgs
-	err := json.NewDecoder(r.Body).Decode(&arg)
+	err := json.NewDecoder(body).Decode(&arg)
 	if err != nil {
 		log.Printf("trouble reading request body: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	if err := purgeBefore(r.Context(), arg.When, arg.Cursor); err != nil {
+	if err := purge(ctx, arg.When, arg.Cursor); err != nil {
 		log.Printf("trouble purging with cursor: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		return err
 	}
-	fmt.Fprintf(w, "OK")
+	return nil
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"google.golang.org/api/iterator"
+)
+
+//TimelineEntry is one version of a resource in its timeline
+//Changed lists the JSON Pointers of the values that differ from the previous version
+type TimelineEntry struct {
+	SnapshotMeta
+	Changed []string `json:"changed"`
+}
+
+//buildTimeline walks the snapshots of uri oldest first comparing each one to its predecessor
+func buildTimeline(ctx context.Context, uri string) ([]TimelineEntry, error) {
+	var (
+		timeline = []TimelineEntry{}
+		prev     interface{}
+		isFirst  = true
+	)
+	t := store.Query(ctx, ResourceQuery{URI: uri, Ascending: true})
+	for {
+		var res Resource
+		if err := t.Next(&res); err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entry := TimelineEntry{SnapshotMeta: res.Meta(), Changed: []string{}}
+		//"seen again" markers have the data of the previous version
+		if res.Ref == "" {
+			doc, err := res.decodeData()
+			if err != nil {
+				return nil, err
+			}
+			if !isFirst {
+				for _, c := range diffJSON("", prev, doc, nil) {
+					entry.Changed = append(entry.Changed, c.Path)
+				}
+			}
+			prev = doc
+			isFirst = false
+		}
+		timeline = append(timeline, entry)
+	}
+	return timeline, nil
+}
+
+//timelineView answers /t/{type}/{id} with the change history of a resource
+func timelineView(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r)
+	w.Header().Add("content-type", "application/json")
+
+	uri, ok := resourceURIFromPath(w, r, "/t/")
+	if !ok {
+		return
+	}
+	timeline, err := buildTimeline(r.Context(), uri)
+	if err != nil {
+		log.Printf("Failed to build timeline of %s: %v", uri, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(timeline); err != nil {
+		log.Printf("Failed to write timeline of %s: %v", uri, err)
+	}
+}
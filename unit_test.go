@@ -1,9 +1,28 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/api/iterator"
 )
 
 func TestPackUnpack(t *testing.T) {
@@ -20,3 +39,1110 @@ func TestPackUnpack(t *testing.T) {
 	ok(t, err)
 	equals(t, str, string(rawstr))
 }
+
+//testBoltStore is a bolt store in its own temporary directory
+type testBoltStore struct {
+	*boltStore
+	dir string
+}
+
+//Close closes the store and removes its directory
+func (s *testBoltStore) Close() error {
+	err := s.boltStore.Close()
+	os.RemoveAll(s.dir)
+	return err
+}
+
+func newTestBoltStore(t *testing.T) *testBoltStore {
+	dir, err := ioutil.TempDir("", "res-log")
+	ok(t, err)
+	s, err := newBoltStore(filepath.Join(dir, "test.db"))
+	ok(t, err)
+	return &testBoltStore{boltStore: s, dir: dir}
+}
+
+//useTestStore makes a new test store the store of the app, the caller closes it
+func useTestStore(t *testing.T) *testBoltStore {
+	s := newTestBoltStore(t)
+	store = s
+	return s
+}
+
+//packedString returns s packed the way snapshot data is stored
+func packedString(t *testing.T, s string) []byte {
+	r, err := pack(strings.NewReader(s))
+	ok(t, err)
+	data, err := ioutil.ReadAll(r)
+	ok(t, err)
+	return data
+}
+
+func TestBoltStore(t *testing.T) {
+	s := newTestBoltStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i, uri := range []string{"tours/1", "tours/2", "tours/1", "departures/1"} {
+		_, err := s.Put(ctx, &Resource{
+			URI:       uri,
+			Type:      strings.Split(uri, "/")[0],
+			FetchDate: now.Add(time.Duration(i) * time.Hour),
+			Sha1:      strconv.Itoa(i),
+		})
+		ok(t, err)
+	}
+
+	var sha []string
+	it := s.Query(ctx, ResourceQuery{URI: "tours/1"})
+	for {
+		var r Resource
+		if err := it.Next(&r); err == iterator.Done {
+			break
+		} else {
+			ok(t, err)
+		}
+		sha = append(sha, r.Sha1)
+	}
+	equals(t, []string{"2", "0"}, sha)
+
+	var r Resource
+	ok(t, s.Query(ctx, ResourceQuery{URI: "tours/1", Until: now.Add(time.Hour)}).Next(&r))
+	equals(t, "0", r.Sha1)
+
+	latest, err := s.LatestByType(ctx, "tours")
+	ok(t, err)
+	equals(t, "tours/1", latest.URI)
+	_, err = s.LatestByType(ctx, "places")
+	equals(t, errNotFound, err)
+
+	ok(t, s.Delete(ctx, []string{latest.Key, "404"}))
+	latest, err = s.LatestByType(ctx, "tours")
+	ok(t, err)
+	equals(t, "1", latest.Sha1)
+	ok(t, s.Query(ctx, ResourceQuery{URI: "tours/1"}).Next(&r))
+	equals(t, "0", r.Sha1)
+}
+
+func TestSaveAndList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"id": 22997, "name": "Peru"}`)
+	}))
+	defer srv.Close()
+	s := useTestStore(t)
+	defer s.Close()
+	ok(t, saveResource(context.Background(), &hookStruct{
+		EventType: "tours.updated",
+		Resource:  "tours",
+		Created:   "2019-01-01T00:00:00Z",
+		Data:      &hookDataAttr{ID: float64(22997), Href: srv.URL},
+	}))
+
+	//without an ID the most recently fetched resource of the type is listed
+	for _, path := range []string{"/l/tours/22997", "/l/tours"} {
+		w := httptest.NewRecorder()
+		resourcesView(w, httptest.NewRequest("GET", path, nil))
+		equals(t, http.StatusOK, w.Code)
+		var list []JSONResource
+		ok(t, json.Unmarshal(w.Body.Bytes(), &list))
+		equals(t, 1, len(list))
+		equals(t, "2019-01-01T00:00:00Z", list[0].HookDate)
+		equals(t, `{"id":22997,"name":"Peru"}`, string(list[0].Data))
+	}
+}
+
+func TestLocalQueue(t *testing.T) {
+	done := make(chan string, 1)
+	handlers := map[string]taskFunc{
+		"/task/echo": func(ctx context.Context, body io.Reader) error {
+			data, err := ioutil.ReadAll(body)
+			done <- string(data)
+			return err
+		},
+	}
+	dir, err := ioutil.TempDir("", "res-log")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	journal, err := newBoltJournal(filepath.Join(dir, "queue.db"))
+	ok(t, err)
+	defer journal.Close()
+	//a job left over from a previous run
+	ok(t, journal.Save(&localJob{Path: "/task/echo", Payload: []byte("again")}))
+
+	q, err := newLocalQueue(handlers, 1, journal)
+	ok(t, err)
+	equals(t, "again", <-done)
+	ok(t, q.Dispatch(context.Background(), "/task/echo", []byte("hello")))
+	equals(t, "hello", <-done)
+
+	//not due so the poller leaves it alone until it is buried
+	job := &localJob{Path: "/task/echo", Payload: []byte("dead"), NextRun: time.Now().Add(time.Hour)}
+	ok(t, journal.Save(job))
+	ok(t, journal.Bury(job))
+	dispatcher = q
+	w := httptest.NewRecorder()
+	deadJobsView(w, httptest.NewRequest("GET", "/admin/queue/dead", nil))
+	var dead []JSONJob
+	ok(t, json.Unmarshal(w.Body.Bytes(), &dead))
+	equals(t, 1, len(dead))
+	equals(t, job.ID, dead[0].ID)
+	w = httptest.NewRecorder()
+	deadJobsView(w, httptest.NewRequest("POST", fmt.Sprintf("/admin/queue/dead/%d/requeue", job.ID), nil))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, "dead", <-done)
+	left, err := journal.Dead()
+	ok(t, err)
+	equals(t, 0, len(left))
+
+	assert(t, q.Dispatch(context.Background(), "/task/missing", nil) != nil, "expected unknown task to fail")
+
+	equals(t, LocalTaskMinBackoff, backoff(1))
+	equals(t, 4*LocalTaskMinBackoff, backoff(3))
+	equals(t, LocalTaskMaxBackoff, backoff(LocalTaskRetryLimit))
+}
+
+func TestLocalQueueRunsOnce(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		runs = make(map[string]int)
+		gate = make(chan struct{})
+	)
+	handlers := map[string]taskFunc{
+		"/task/count": func(ctx context.Context, body io.Reader) error {
+			data, _ := ioutil.ReadAll(body)
+			mu.Lock()
+			runs[string(data)]++
+			mu.Unlock()
+			switch string(data) {
+			case "gated":
+				<-gate
+			case "fail":
+				return fmt.Errorf("failed")
+			}
+			return nil
+		},
+	}
+	dir, err := ioutil.TempDir("", "res-log")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	journal, err := newBoltJournal(filepath.Join(dir, "queue.db"))
+	ok(t, err)
+	defer journal.Close()
+	//two failing jobs ahead of one held up until the poller has been woken many times
+	for _, payload := range []string{"fail", "fail", "gated"} {
+		ok(t, journal.Save(&localJob{Path: "/task/count", Payload: []byte(payload)}))
+	}
+	q, err := newLocalQueue(handlers, 1, journal)
+	ok(t, err)
+	poke := func() {
+		for i := 0; i < 20; i++ {
+			q.notify()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	poke()
+	close(gate)
+	poke()
+
+	mu.Lock()
+	equals(t, map[string]int{"fail": 2, "gated": 1}, runs)
+	mu.Unlock()
+	//the failed jobs wait for their backoff
+	pending, err := journal.Pending()
+	ok(t, err)
+	equals(t, 2, len(pending))
+	for _, job := range pending {
+		equals(t, 1, job.Attempts)
+		assert(t, job.NextRun.After(time.Now()), "expected the retry to wait")
+	}
+}
+
+func TestSaveResourceDedup(t *testing.T) {
+	body := `{"id": 1, "name": "first"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	hook := &hookStruct{
+		EventType: "tours.updated",
+		Resource:  "tours",
+		Created:   "2019-01-01T00:00:00Z",
+		Data:      &hookDataAttr{ID: float64(1), Href: srv.URL},
+	}
+	ok(t, saveResource(ctx, hook))
+	ok(t, saveResource(ctx, hook))
+	body = `{"id": 1, "name": "second"}`
+	ok(t, saveResource(ctx, hook))
+
+	var (
+		snapshots []Resource
+		refs      = make(map[string][]byte)
+	)
+	it := s.Query(ctx, ResourceQuery{URI: "tours/1"})
+	for {
+		var r Resource
+		if err := it.Next(&r); err == iterator.Done {
+			break
+		} else {
+			ok(t, err)
+		}
+		snapshots = append(snapshots, r)
+	}
+	equals(t, 3, len(snapshots))
+	equals(t, "", snapshots[0].Ref)
+	equals(t, snapshots[2].Key, snapshots[1].Ref)
+	equals(t, 0, len(snapshots[1].Data))
+	ok(t, resolveData(ctx, &snapshots[1], refs))
+	equals(t, snapshots[2].Data, snapshots[1].Data)
+}
+
+func TestDiffJSON(t *testing.T) {
+	var a, b interface{}
+	ok(t, json.Unmarshal([]byte(`{"name":"x","a/b":1,"tags":["p","q"],"gone":true,"nested":{"v":1}}`), &a))
+	ok(t, json.Unmarshal([]byte(`{"name":"y","a/b":1,"tags":["p"],"new":null,"nested":{"v":2}}`), &b))
+	changes := diffJSON("", a, b, nil)
+	equals(t, []Change{
+		{Op: OpRemove, Path: "/gone", Old: true},
+		{Op: OpReplace, Path: "/name", Old: "x", Value: "y"},
+		{Op: OpReplace, Path: "/nested/v", Old: float64(1), Value: float64(2)},
+		{Op: OpAdd, Path: "/new"},
+		{Op: OpRemove, Path: "/tags/1", Old: "q"},
+	}, changes)
+	equals(t, 0, len(diffJSON("", a, a, nil)))
+}
+
+func TestDiffViewDefaultBase(t *testing.T) {
+	body := `{"id": 1, "name": "first"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	hook := &hookStruct{
+		EventType: "tours.updated",
+		Resource:  "tours",
+		Data:      &hookDataAttr{ID: float64(1), Href: srv.URL},
+	}
+	ok(t, saveResource(ctx, hook))
+	body = `{"id": 1, "name": "second"}`
+	ok(t, saveResource(ctx, hook))
+	//seen again
+	ok(t, saveResource(ctx, hook))
+
+	w := httptest.NewRecorder()
+	diffView(w, httptest.NewRequest("GET", "/d/tours/1", nil))
+	equals(t, http.StatusOK, w.Code)
+	var result DiffResult
+	ok(t, json.Unmarshal(w.Body.Bytes(), &result))
+	equals(t, []Change{{Op: OpReplace, Path: "/name", Old: "first", Value: "second"}}, result.Changes)
+}
+
+func TestBuildTimeline(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i, body := range []string{`{"a":1,"b":1}`, `{"a":1,"b":2}`, `{"a":2,"b":2}`} {
+		packed := packedString(t, body)
+		_, err := s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", Data: packed, FetchDate: now.Add(time.Duration(i) * time.Minute)})
+		ok(t, err)
+	}
+	timeline, err := buildTimeline(ctx, "tours/1")
+	ok(t, err)
+	equals(t, 3, len(timeline))
+	equals(t, []string{}, timeline[0].Changed)
+	equals(t, []string{"/b"}, timeline[1].Changed)
+	equals(t, []string{"/a"}, timeline[2].Changed)
+}
+
+func TestFieldHistory(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for i, body := range []string{`{"status":"A"}`, `{"status":"B"}`, `{"status":"A"}`, `{}`} {
+		packed := packedString(t, body)
+		_, err := s.Put(ctx, &Resource{URI: "departures/1", Type: "departures", Data: packed, FetchDate: now.Add(time.Duration(i) * time.Minute)})
+		ok(t, err)
+	}
+	history, err := fieldHistory(ctx, "departures/1", []string{"status"})
+	ok(t, err)
+	equals(t, 3, len(history))
+	equals(t, "A", history[0].Value)
+	equals(t, now.Format(jsLayout), history[0].FetchDate)
+	equals(t, "B", history[1].Value)
+	assert(t, history[2].Missing, "expected the field to go missing last")
+}
+
+func TestParseFieldPath(t *testing.T) {
+	for path, exp := range map[string][]string{
+		"/availability/status":           {"availability", "status"},
+		"/a~1b/c~0d":                     {"a/b", "c~d"},
+		"availability.status":            {"availability", "status"},
+		"$.lowest_pp2a_prices[0].amount": {"lowest_pp2a_prices", "0", "amount"},
+		"$['name']":                      {"name"},
+	} {
+		tokens, err := parseFieldPath(path)
+		ok(t, err)
+		equals(t, exp, tokens)
+	}
+	_, err := parseFieldPath("a[0")
+	assert(t, err != nil, "expected malformed path to fail")
+
+	var doc interface{}
+	ok(t, json.Unmarshal([]byte(`{"prices":[{"amount":10}]}`), &doc))
+	val, found := lookupPath(doc, []string{"prices", "0", "amount"})
+	assert(t, found, "expected to find the amount")
+	equals(t, float64(10), val)
+	_, found = lookupPath(doc, []string{"prices", "1"})
+	assert(t, !found, "expected out of range index to be missing")
+}
+
+func TestResourcesViewAt(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	when := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, body := range []string{`{"v":1}`, `{"v":2}`} {
+		packed := packedString(t, body)
+		_, err := s.Put(ctx, &Resource{URI: "tours/22997", Type: "tours", Data: packed, FetchDate: when.Add(time.Duration(i) * time.Hour)})
+		ok(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	resourcesView(w, httptest.NewRequest("GET", "/l/tours/22997?at=2024-03-01T12:30:00Z", nil))
+	equals(t, http.StatusOK, w.Code)
+	var jsr JSONResource
+	ok(t, json.Unmarshal(w.Body.Bytes(), &jsr))
+	equals(t, "2024-03-01T12:00:00Z", jsr.FetchDate)
+	equals(t, `{"v":1}`, string(jsr.Data))
+
+	w = httptest.NewRecorder()
+	resourcesView(w, httptest.NewRequest("GET", "/l/tours/22997?at=2024-03-01T11:00:00Z", nil))
+	equals(t, http.StatusNotFound, w.Code)
+}
+
+func TestResourcesViewPaging(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	when := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, event := range []string{"tours.created", "tours.updated", "tours.updated"} {
+		_, err := s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", EventType: event, Sha1: strconv.Itoa(i), FetchDate: when.Add(time.Duration(i) * time.Hour)})
+		ok(t, err)
+	}
+	page := func(query string) ([]string, string) {
+		w := httptest.NewRecorder()
+		resourcesView(w, httptest.NewRequest("GET", "/l/tours/1?"+query, nil))
+		equals(t, http.StatusOK, w.Code)
+		var list []JSONResource
+		ok(t, json.Unmarshal(w.Body.Bytes(), &list))
+		var sha []string
+		for _, jsr := range list {
+			sha = append(sha, jsr.Sha1)
+		}
+		return sha, w.Header().Get("X-Next-Cursor")
+	}
+
+	sha, next := page("limit=2")
+	equals(t, []string{"2", "1"}, sha)
+	assert(t, next != "", "expected a next cursor")
+	sha, next = page("limit=2&cursor=" + next)
+	equals(t, []string{"0"}, sha)
+	equals(t, "", next)
+	sha, _ = page("since=2024-03-01T12:30:00Z&until=2024-03-01T13:00:00Z")
+	equals(t, []string{"1"}, sha)
+	sha, _ = page("event_type=created")
+	equals(t, []string{"0"}, sha)
+	sha, next = page("event_type=tours.updated&limit=1")
+	equals(t, []string{"2"}, sha)
+	sha, _ = page("event_type=tours.updated&limit=1&cursor=" + next)
+	equals(t, []string{"1"}, sha)
+
+	//a plain listing is not paged
+	for i := 3; i <= DefaultPageSize; i++ {
+		_, err := s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", Sha1: strconv.Itoa(i), FetchDate: when.Add(time.Duration(i) * time.Hour)})
+		ok(t, err)
+	}
+	sha, next = page("")
+	equals(t, DefaultPageSize+1, len(sha))
+	equals(t, "", next)
+
+	for _, cursor := range []string{"not-a-cursor", "dG91cnMvMQ"} {
+		w := httptest.NewRecorder()
+		resourcesView(w, httptest.NewRequest("GET", "/l/tours/1?cursor="+cursor, nil))
+		equals(t, http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestResourcesViewMeta(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	packed := packedString(t, `{"v":1}`)
+	key, err := s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", Sha1: "a", Data: packed, FetchDate: time.Now().UTC()})
+	ok(t, err)
+
+	w := httptest.NewRecorder()
+	resourcesView(w, httptest.NewRequest("GET", "/l/tours/1?fields=meta", nil))
+	var list []map[string]interface{}
+	ok(t, json.Unmarshal(w.Body.Bytes(), &list))
+	equals(t, 1, len(list))
+	equals(t, key, list[0]["key"])
+	_, hasData := list[0]["resource"]
+	assert(t, !hasData, "expected no resource data in meta listing")
+
+	w = httptest.NewRecorder()
+	resourcesView(w, httptest.NewRequest("GET", "/l/tours/1?key="+key, nil))
+	var jsr JSONResource
+	ok(t, json.Unmarshal(w.Body.Bytes(), &jsr))
+	equals(t, `{"v":1}`, string(jsr.Data))
+
+	w = httptest.NewRecorder()
+	resourcesView(w, httptest.NewRequest("GET", "/l/tours/2?key="+key, nil))
+	equals(t, http.StatusNotFound, w.Code)
+}
+
+func TestSnapshotGzipPassthrough(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	packed := packedString(t, `{"v":1}`)
+	key, err := s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", Sha1: "a", Data: packed, FetchDate: time.Now().UTC()})
+	ok(t, err)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/l/tours/1?key="+key, nil)
+	req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	resourcesView(w, req)
+	equals(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	ok(t, err)
+	var jsr JSONResource
+	ok(t, json.NewDecoder(gz).Decode(&jsr))
+	equals(t, key, jsr.Key)
+	equals(t, `{"v":1}`, string(jsr.Data))
+
+	for enc, accepted := range map[string]bool{
+		"gzip;q=0":        false,
+		"gzip; q=0.0":     false,
+		"br, gzip;q=0.00": false,
+		"gzip;q=0.5":      true,
+		"identity":        false,
+	} {
+		req.Header.Set("Accept-Encoding", enc)
+		equals(t, accepted, acceptsGzip(req))
+	}
+}
+
+func TestSaveTombstone(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	ctx := context.Background()
+	hook := &hookStruct{
+		EventType: "departures.deleted",
+		Resource:  "departures",
+		Created:   "2019-01-01T00:00:00Z",
+		Data:      &hookDataAttr{ID: "595943", Href: "http://127.0.0.1:0/gone"},
+	}
+	ok(t, saveResource(ctx, hook))
+	last, err := latestForURI(ctx, "departures/595943")
+	ok(t, err)
+	assert(t, last.Deleted, "expected a tombstone")
+	equals(t, hook.Created, last.HookDate)
+	equals(t, 0, len(last.Data))
+}
+
+//recordingDispatcher keeps the tasks dispatched instead of running them
+type recordingDispatcher struct {
+	paths    []string
+	payloads [][]byte
+}
+
+func (d *recordingDispatcher) Dispatch(ctx context.Context, handlerPath string, payload []byte) error {
+	d.paths = append(d.paths, handlerPath)
+	d.payloads = append(d.payloads, payload)
+	return nil
+}
+
+func TestHookLog(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	hookLog = s
+	d := &recordingDispatcher{}
+	dispatcher = d
+	for _, body := range []string{
+		`[{"event_type":"tours.updated","resource":"tours","data":{"id":1,"href":"x"}}]`,
+		`[{"event_type":"departures.updated","resource":"departures","data":{"id":2,"href":"y"}}]`,
+		`not json`,
+	} {
+		packed := packedString(t, body)
+		logBatch(httptest.NewRequest("POST", "/r", nil), packed, true)
+	}
+	ctx := context.Background()
+
+	batches, next, err := hookLog.QueryBatches(ctx, BatchQuery{Limit: 2})
+	ok(t, err)
+	equals(t, 2, len(batches))
+	assert(t, batches[0].Error != "", "expected the last batch to fail decoding")
+	batches, next, err = hookLog.QueryBatches(ctx, BatchQuery{Limit: 2, Cursor: next})
+	ok(t, err)
+	equals(t, 1, len(batches))
+	equals(t, "", next)
+	batches, _, err = hookLog.QueryBatches(ctx, BatchQuery{Limit: 10, Resource: "departures"})
+	ok(t, err)
+	equals(t, 1, len(batches))
+	equals(t, []string{"departures.updated"}, batches[0].EventTypes)
+	all, _, err := hookLog.QueryBatches(ctx, BatchQuery{})
+	ok(t, err)
+	equals(t, 3, len(all))
+
+	cfg.AdminKey = "secret"
+	defer func() { cfg.AdminKey = "" }()
+	mux := getMux()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/events/"+batches[0].Key+"/replay", nil))
+	equals(t, http.StatusForbidden, w.Code)
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/events/"+batches[0].Key+"/replay", nil)
+	req.Header.Set("X-Admin-Key", "secret")
+	mux.ServeHTTP(w, req)
+	equals(t, http.StatusOK, w.Code)
+	equals(t, []string{"/task/process_hook"}, d.paths)
+
+	//a batch failing verification is only noted
+	logBatch(httptest.NewRequest("POST", "/r", strings.NewReader("junk")), []byte("junk"), false)
+	batches, _, err = hookLog.QueryBatches(ctx, BatchQuery{Limit: 1})
+	ok(t, err)
+	assert(t, !batches[0].Valid && batches[0].Data == nil && batches[0].Headers == "", "expected a short record, got %#v", batches[0])
+
+	n, err := hookLog.DeleteBatches(ctx, all[0].Received.Add(time.Nanosecond))
+	ok(t, err)
+	equals(t, 3, n)
+	batches, _, err = hookLog.QueryBatches(ctx, BatchQuery{})
+	ok(t, err)
+	equals(t, 1, len(batches))
+}
+
+func TestBackfill(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.String() {
+		case "/tours/":
+			fmt.Fprintf(w, `{"results":[{"id":1,"href":"%s/tours/1"}],"links":[{"rel":"next","href":"%s/tours/?page=2"}]}`, srv.URL, srv.URL)
+		case "/tours/?page=2":
+			fmt.Fprintf(w, `{"results":[{"id":2,"href":"%s/tours/2"}],"links":[]}`, srv.URL)
+		default:
+			fmt.Fprintf(w, `{"href":"%s"}`, r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+	s := useTestStore(t)
+	defer s.Close()
+	cfg.APIBase = srv.URL
+	defer func() { cfg.APIBase = "" }()
+
+	ctx := context.Background()
+	ok(t, backfill(ctx, "tours", ""))
+	for _, uri := range []string{"tours/1", "tours/2"} {
+		last, err := latestForURI(ctx, uri)
+		ok(t, err)
+		equals(t, "tours.backfill", last.EventType)
+	}
+
+	//resuming from a later page skips the earlier ones
+	ok(t, runCommand(ctx, []string{"backfill", "-page", srv.URL + "/tours/?page=2", "places"}))
+	_, err := latestForURI(ctx, "places/2")
+	ok(t, err)
+	_, err = latestForURI(ctx, "places/1")
+	equals(t, errNotFound, err)
+	assert(t, runCommand(ctx, []string{"backfill", "-page"}) != nil, "expected a usage error")
+}
+
+func TestFetchDataStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(code)
+		io.WriteString(w, `{"id":1}`)
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	for code, unusable := range map[int]bool{
+		http.StatusNotFound:            true,
+		http.StatusGone:                true,
+		http.StatusForbidden:           true,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	} {
+		_, _, err := fetchData(ctx, srv.URL+"/"+strconv.Itoa(code))
+		assert(t, err != nil, "expected an error for status %d", code)
+		equals(t, unusable, err == errUnusable)
+	}
+	_, _, err := fetchData(ctx, srv.URL+"/200")
+	ok(t, err)
+}
+
+func TestReconcile(t *testing.T) {
+	body := `{"id":1}`
+	sum := sha1.Sum([]byte(body))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+	s := useTestStore(t)
+	defer s.Close()
+	reconcileLog = s
+	cfg.APIBase = srv.URL
+	defer func() { cfg.APIBase = "" }()
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for _, r := range []*Resource{
+		{URI: "tours/1", Type: "tours", FetchDate: now, Sha1: hex.EncodeToString(sum[:])},
+		{URI: "tours/2", Type: "tours", FetchDate: now, Sha1: "stale"},
+		{URI: "tours/2", Type: "tours", FetchDate: now.Add(-time.Hour), Sha1: "older"},
+		{URI: "dossiers/1", Type: "dossiers", FetchDate: now, Deleted: true},
+	} {
+		_, err := s.Put(ctx, r)
+		ok(t, err)
+	}
+
+	uris, next, err := s.URIs(ctx, "", 2)
+	ok(t, err)
+	equals(t, []string{"dossiers/1", "tours/1"}, uris)
+	uris, next, err = s.URIs(ctx, next, 2)
+	ok(t, err)
+	equals(t, []string{"tours/2"}, uris)
+	equals(t, "", next)
+
+	//ignored types are not fetched again
+	_, err = s.Put(ctx, &Resource{URI: "places/1", Type: "places", FetchDate: now, Sha1: "stale"})
+	ok(t, err)
+	cfg.IgnoredTypes = []string{"places"}
+	defer func() { cfg.IgnoredTypes = nil }()
+
+	report, err := reconcile(ctx)
+	ok(t, err)
+	equals(t, 3, report.Checked)
+	equals(t, 1, report.Drifted)
+	equals(t, 0, report.Failed)
+	equals(t, []string{"tours/2"}, report.DriftedURIs)
+	last, err := latestForURI(ctx, "tours/2")
+	ok(t, err)
+	assert(t, last.Drift, "expected latest snapshot of tours/2 to be flagged as drift")
+	equals(t, "tours.reconcile", last.EventType)
+
+	reports, err := s.Reports(ctx, 10)
+	ok(t, err)
+	equals(t, 1, len(reports))
+	equals(t, 1, reports[0].Drifted)
+}
+
+func TestPurgeRetention(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	hookLog = s
+	cfg.Retention = map[string]RetentionRule{
+		"*":          {Days: 10},
+		"departures": {Days: 2, KeepLatest: 2},
+		"dossiers":   {Days: 2, KeepFirst: true},
+	}
+	defer func() { cfg.Retention = nil }()
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	for _, uri := range []string{"tours/1", "departures/1", "dossiers/1", "places/1"} {
+		days := []int{20, 15, 5, 4, 1}
+		if uri == "places/1" {
+			//not changed for a long time
+			days = days[:2]
+		}
+		for _, days := range days {
+			_, err := s.Put(ctx, &Resource{
+				URI:       uri,
+				Type:      strings.Split(uri, "/")[0],
+				FetchDate: now.AddDate(0, 0, -days),
+				Sha1:      strconv.Itoa(days),
+			})
+			ok(t, err)
+		}
+	}
+	//a seen again marker keeps the snapshot it refers to
+	old, err := snapshotAt(ctx, "tours/1", now.AddDate(0, 0, -15))
+	ok(t, err)
+	_, err = s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", FetchDate: now, Sha1: "15", Ref: old.Key})
+	ok(t, err)
+
+	snapshots, err := s.Snapshots(ctx, "tours/1")
+	ok(t, err)
+	equals(t, 6, len(snapshots))
+	equals(t, old.Key, snapshots[0].Ref)
+	equals(t, now.AddDate(0, 0, -20).UnixNano(), snapshots[5].FetchDate.UnixNano())
+
+	ok(t, purge(ctx, now, ""))
+	for uri, want := range map[string][]string{
+		"tours/1":      {"15", "1", "4", "5", "15"},
+		"departures/1": {"1", "4"},
+		"dossiers/1":   {"1", "20"},
+		"places/1":     {"15"},
+	} {
+		var sha []string
+		it := s.Query(ctx, ResourceQuery{URI: uri})
+		for {
+			var r Resource
+			if err := it.Next(&r); err == iterator.Done {
+				break
+			} else {
+				ok(t, err)
+			}
+			sha = append(sha, r.Sha1)
+		}
+		equals(t, want, sha)
+	}
+}
+
+func TestBoltIndexRefs(t *testing.T) {
+	s := newTestBoltStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC()
+	first := &Resource{URI: "tours/1", Type: "tours", FetchDate: now.Add(-time.Hour), Sha1: "a"}
+	_, err := s.Put(ctx, first)
+	ok(t, err)
+	marker := &Resource{URI: "tours/1", Type: "tours", FetchDate: now, Sha1: "a", Ref: first.Key}
+	_, err = s.Put(ctx, marker)
+	ok(t, err)
+	//make it look like a database from before the uri index held the Ref
+	ok(t, s.db.Update(func(tx *bolt.Tx) error {
+		seq, _ := strconv.ParseUint(marker.Key, 10, 64)
+		if err := tx.Bucket(bktByURI).Put(indexKey(marker.URI, encodeTime(marker.FetchDate), encodeUint(seq)), nil); err != nil {
+			return err
+		}
+		return tx.Bucket(bktMeta).Delete(keyIndexRefs)
+	}))
+	path := s.db.Path()
+	ok(t, s.boltStore.Close())
+
+	s.boltStore, err = newBoltStore(path)
+	ok(t, err)
+	defer s.Close()
+	snapshots, err := s.Snapshots(ctx, "tours/1")
+	ok(t, err)
+	equals(t, 2, len(snapshots))
+	equals(t, first.Key, snapshots[0].Ref)
+	equals(t, "", snapshots[1].Ref)
+}
+
+func TestOpenArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "res-log-archive")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	defer func() { cfg.ArchiveDir = "" }()
+	cfg.ArchiveDir = filepath.Join(dir, "archive")
+	a, err := openArchive()
+	ok(t, err)
+	equals(t, dirArchive(cfg.ArchiveDir), a)
+
+	//a file where the directory should be stands in for a read only file system
+	blocker := filepath.Join(dir, "blocker")
+	ok(t, ioutil.WriteFile(blocker, nil, 0600))
+	cfg.ArchiveDir = filepath.Join(blocker, "archive")
+	_, err = openArchive()
+	assert(t, err != nil && strings.Contains(err.Error(), "writable ArchiveDir"), "expected a clear error, got %v", err)
+}
+
+func TestArchiveRestore(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	hookLog = s
+	dir, err := ioutil.TempDir("", "res-log-archive")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	archive = dirArchive(dir)
+	defer func() { archive = nil }()
+
+	ctx := context.Background()
+	now := time.Now().UTC()
+	data := packedString(t, `{"id": 1}`)
+	first := &Resource{URI: "tours/1", Type: "tours", FetchDate: now.AddDate(0, 0, -40), Data: data, Sha1: "a"}
+	_, err = s.Put(ctx, first)
+	ok(t, err)
+	_, err = s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", FetchDate: now.AddDate(0, 0, -35), Sha1: "a", Ref: first.Key})
+	ok(t, err)
+	_, err = s.Put(ctx, &Resource{URI: "tours/1", Type: "tours", FetchDate: now, Sha1: "b"})
+	ok(t, err)
+
+	ok(t, purge(ctx, now, ""))
+	_, err = snapshotAt(ctx, "tours/1", now.AddDate(0, 0, -1))
+	equals(t, errNotFound, err)
+
+	//the seen again marker is archived with the data it refers to
+	name := archiveName(&Resource{Type: "tours", FetchDate: now.AddDate(0, 0, -35)})
+	n, err := restoreArchive(ctx, name)
+	ok(t, err)
+	equals(t, 1, n)
+	res, err := snapshotAt(ctx, "tours/1", now.AddDate(0, 0, -1))
+	ok(t, err)
+	equals(t, "a", res.Sha1)
+	doc, err := res.decodeData()
+	ok(t, err)
+	equals(t, map[string]interface{}{"id": json.Number("1")}, doc)
+
+	n, err = restoreArchive(ctx, name)
+	ok(t, err)
+	equals(t, 0, n)
+	_, err = restoreArchive(ctx, "../etc/passwd")
+	assert(t, err != nil, "expected names outside the archive to be refused")
+}
+
+func TestNotifyChange(t *testing.T) {
+	body := `{"id": 1, "name": "first", "price": 10}`
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer api.Close()
+	//the handler runs in the server goroutine so it only hands the request over
+	type delivery struct {
+		body      []byte
+		signature string
+	}
+	deliveries := make(chan delivery, 1)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		deliveries <- delivery{data, r.Header.Get("X-Res-Log-Signature")}
+	}))
+	defer sub.Close()
+	s := useTestStore(t)
+	defer s.Close()
+	d := &recordingDispatcher{}
+	dispatcher = d
+	//two subscribers at the same URL with different secrets
+	cfg.Subscribers = []Subscriber{
+		{URL: "http://departures.example.com", Types: []string{"departures"}},
+		{URL: sub.URL, Types: []string{"places"}, Secret: "other"},
+		{URL: sub.URL, Types: []string{"tours"}, Paths: []string{"$.price"}, Secret: "secret"},
+	}
+	defer func() { cfg.Subscribers = nil }()
+
+	ctx := context.Background()
+	hook := &hookStruct{
+		EventType: "tours.updated",
+		Resource:  "tours",
+		Data:      &hookDataAttr{ID: float64(1), Href: api.URL},
+	}
+	ok(t, saveResource(ctx, hook))
+	equals(t, 1, len(d.paths))
+	//unchanged and changes to other fields are not sent
+	ok(t, saveResource(ctx, hook))
+	body = `{"id": 1, "name": "second", "price": 10}`
+	ok(t, saveResource(ctx, hook))
+	equals(t, 1, len(d.paths))
+	body = `{"id": 1, "name": "second", "price": 12}`
+	ok(t, saveResource(ctx, hook))
+	equals(t, []string{"/task/notify", "/task/notify"}, d.paths)
+
+	ok(t, notifyTask(ctx, bytes.NewReader(d.payloads[1])))
+	got := <-deliveries
+	equals(t, sign("secret", got.body), got.signature)
+	var received ChangeNotification
+	ok(t, json.Unmarshal(got.body, &received))
+	equals(t, "tours/1", received.URI)
+	equals(t, []Change{{Op: OpReplace, Path: "/price", Old: 10.0, Value: 12.0}}, received.Changes)
+	assert(t, received.OldSha1 != received.NewSha1, "expected the sha1 to change")
+
+	//a subscriber removed from the config is not notified
+	cfg.Subscribers = cfg.Subscribers[:1]
+	ok(t, notifyTask(ctx, bytes.NewReader(d.payloads[1])))
+	equals(t, 0, len(deliveries))
+
+	//types are matched however they are written in the config
+	mixed := &Subscriber{Types: []string{" Tours"}}
+	assert(t, mixed.wants("tours"), "expected %v to want tours", mixed.Types)
+}
+
+func TestLiveFeed(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	srv := httptest.NewServer(http.HandlerFunc(liveView))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/live?type=tours&id=1")
+	ok(t, err)
+	defer resp.Body.Close()
+	equals(t, "text/event-stream", resp.Header.Get("content-type"))
+	for i := 0; ; i++ {
+		feed.mu.Lock()
+		n := len(feed.clients)
+		feed.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		assert(t, i < 100, "expected the live client to subscribe")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	data := packedString(t, `{"id": 1}`)
+	feed.publish(&Resource{URI: "tours/2", Type: "tours", Key: "1", Data: data})
+	feed.publish(&Resource{URI: "tours/1", Type: "tours", Key: "2", Data: data, Sha1: "abc"})
+
+	rdr := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := rdr.ReadString('\n')
+		ok(t, err)
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	equals(t, "id: 2", lines[0])
+	equals(t, "event: snapshot", lines[1])
+	var jsr JSONResource
+	ok(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &jsr))
+	equals(t, "tours/1", jsr.URI)
+	equals(t, "abc", jsr.Sha1)
+	equals(t, `{"id":1}`, string(jsr.Data))
+}
+
+func TestWatchRules(t *testing.T) {
+	body := `{"id": 1, "availability": {"status": "AVAILABLE"}}`
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer api.Close()
+	//the handler runs in the server goroutine so it only hands the body over
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies <- data
+	}))
+	defer hook.Close()
+	s := useTestStore(t)
+	defer s.Close()
+	alertLog = s
+	d := &recordingDispatcher{}
+	dispatcher = d
+	cfg.WatchRules = []WatchRule{
+		{Name: "closed", Resource: "departures/*", Path: "availability.status", To: "CLOSED", Notify: []string{"ops"}},
+		{Name: "status", Resource: "departures/2", Path: "/availability/status"},
+	}
+	cfg.Notifiers = map[string]NotifierConfig{"ops": {Kind: "webhook", URL: hook.URL}}
+	defer func() { cfg.WatchRules, cfg.Notifiers = nil, nil }()
+
+	ctx := context.Background()
+	h := &hookStruct{
+		EventType: "departures.updated",
+		Resource:  "departures",
+		Data:      &hookDataAttr{ID: float64(1), Href: api.URL},
+	}
+	ok(t, saveResource(ctx, h))
+	//the first snapshot of a watched resource raises no alert
+	ok(t, saveResource(ctx, &hookStruct{
+		EventType: "departures.created",
+		Resource:  "departures",
+		Data:      &hookDataAttr{ID: float64(2), Href: api.URL},
+	}))
+	alerts, _, err := alertLog.QueryAlerts(ctx, AlertQuery{Limit: 10})
+	ok(t, err)
+	equals(t, 0, len(alerts))
+	body = `{"id": 1, "availability": {"status": "LIMITED"}}`
+	ok(t, saveResource(ctx, h))
+	body = `{"id": 1, "availability": {"status": "CLOSED"}}`
+	ok(t, saveResource(ctx, h))
+
+	alerts, _, err = alertLog.QueryAlerts(ctx, AlertQuery{Limit: 10})
+	ok(t, err)
+	equals(t, 1, len(alerts))
+	equals(t, "closed", alerts[0].Rule)
+	//no limit returns them all
+	all, _, err := alertLog.QueryAlerts(ctx, AlertQuery{})
+	ok(t, err)
+	equals(t, alerts, all)
+	equals(t, "departures/1", alerts[0].URI)
+	equals(t, `"LIMITED"`, alerts[0].Old)
+	equals(t, `"CLOSED"`, alerts[0].New)
+
+	equals(t, []string{"/task/alert"}, d.paths)
+	ok(t, alertTask(ctx, bytes.NewReader(d.payloads[0])))
+	var received JSONAlert
+	ok(t, json.Unmarshal(<-bodies, &received))
+	equals(t, "closed", received.Rule)
+	equals(t, json.RawMessage(`"CLOSED"`), received.New)
+}
+
+func TestAPIKeys(t *testing.T) {
+	s := useTestStore(t)
+	defer s.Close()
+	keyStore = s
+	ctx := context.Background()
+	_, err := s.Put(ctx, &Resource{URI: "payments/1", Type: "payments", FetchDate: time.Now().UTC(), Sha1: "a"})
+	ok(t, err)
+
+	list := func(key string) int {
+		r := httptest.NewRequest("GET", "/l/payments/1", nil)
+		if key != "" {
+			r.Header.Set("X-Api-Key", key)
+		}
+		w := httptest.NewRecorder()
+		resourcesView(w, r)
+		return w.Code
+	}
+	issue := func(types string) IssuedKey {
+		w := httptest.NewRecorder()
+		keysView(w, httptest.NewRequest("POST", "/admin/keys?name=partner&types="+types, nil))
+		equals(t, http.StatusOK, w.Code)
+		var issued IssuedKey
+		ok(t, json.NewDecoder(w.Body).Decode(&issued))
+		return issued
+	}
+
+	equals(t, http.StatusForbidden, list(""))
+	equals(t, http.StatusForbidden, list("made up"))
+	equals(t, http.StatusForbidden, list(issue("documents").Key))
+	payments := issue("documents,payments")
+	equals(t, http.StatusOK, list(payments.Key))
+
+	w := httptest.NewRecorder()
+	keysView(w, httptest.NewRequest("DELETE", "/admin/keys/"+payments.ID, nil))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, http.StatusForbidden, list(payments.Key))
+
+	keys, err := keyStore.Keys(ctx)
+	ok(t, err)
+	equals(t, 2, len(keys))
+	//the key itself is never stored
+	assert(t, keys[0].ID != payments.Key && keys[1].ID != payments.Key, "expected only the key hash to be stored")
+
+	//types are trimmed when issued and compared like the configured ones
+	spaced := issue("documents,%20Payments%20,")
+	equals(t, []string{"documents", "Payments"}, spaced.Types)
+	equals(t, http.StatusOK, list(spaced.Key))
+	assert(t, (&APIKey{Types: []string{" PAYMENTS"}}).allows("payments"), "expected types to be normalised")
+}
+
+func TestResourceTypesConfig(t *testing.T) {
+	assert(t, isPrivate("Payments "), "expected payments to be private by default")
+	assert(t, !isIgnored("payments"), "expected nothing to be ignored by default")
+
+	cfg.PrivateTypes = []string{"agents"}
+	cfg.IgnoredTypes = []string{"documents"}
+	defer func() { cfg.PrivateTypes, cfg.AllowedTypes, cfg.IgnoredTypes = nil, nil, nil }()
+	assert(t, !isPrivate("payments"), "expected payments to be public")
+	assert(t, isPrivate("agents"), "expected agents to be private")
+
+	d := &recordingDispatcher{}
+	dispatcher = d
+	pr, err := pack(strings.NewReader(`[
+		{"event_type":"tours.updated","resource":"tours","data":{"id":1,"href":"x"}},
+		{"event_type":"documents.created","resource":"documents","data":{"id":2,"href":"y"}}
+	]`))
+	ok(t, err)
+	ok(t, processHook(context.Background(), pr))
+	equals(t, 1, len(d.payloads))
+	assert(t, strings.Contains(string(d.payloads[0]), "tours.updated"), "expected only the tours hook to be saved")
+
+	cfg.AllowedTypes = []string{"departures"}
+	assert(t, isIgnored("tours"), "expected types that are not allowed to be ignored")
+	assert(t, !isIgnored("departures"), "expected allowed types to be stored")
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//WatchRule raises an alert when a field of the matching resources changes
+type WatchRule struct {
+	//Name identifies the rule in alerts
+	Name string
+	//Resource is a pattern matched against resource URIs like departures/* or tours/123
+	Resource string
+	//Path is the field watched given as a JSON Pointer or simple JSONPath
+	Path string
+	//To limits the alerts to changes to this value, any change when not set
+	To interface{}
+	//Notify are the names of the notifiers the alerts are sent to
+	Notify []string
+}
+
+//NotifierConfig configures a notifier, Kind selects the implementation from notifierKinds
+type NotifierConfig struct {
+	Kind string
+	//URL and Secret are used by webhook notifiers, the body is signed like change notifications
+	URL    string
+	Secret string
+	//Addr is the host:port of the mail server, From and To the addresses used by smtp notifiers
+	Addr string
+	From string
+	To   []string
+}
+
+//Notifier delivers alerts
+type Notifier interface {
+	Notify(ctx context.Context, a *Alert) error
+}
+
+//notifierKinds builds the notifier of every kind usable in NotifierConfig
+var notifierKinds = map[string]func(NotifierConfig) Notifier{
+	"webhook": func(c NotifierConfig) Notifier { return &webhookNotifier{c.URL, c.Secret} },
+	"smtp":    func(c NotifierConfig) Notifier { return &smtpNotifier{c.Addr, c.From, c.To} },
+}
+
+//Alert records a watch rule matching a new snapshot
+type Alert struct {
+	Rule    string
+	URI     string
+	Path    string
+	Created time.Time
+	//Snapshot is the key of the snapshot that raised the alert
+	Snapshot string `datastore:",noindex"`
+	//Old and New are the JSON encoded values of the field, empty when it was missing
+	Old string `datastore:",noindex"`
+	New string `datastore:",noindex"`
+	Key string `datastore:"-"`
+}
+
+//JSONAlert is the same as Alert but more suitable for serializing
+type JSONAlert struct {
+	Key      string          `json:"key"`
+	Rule     string          `json:"rule"`
+	URI      string          `json:"uri"`
+	Path     string          `json:"path"`
+	Created  string          `json:"created"`
+	Snapshot string          `json:"snapshot"`
+	Old      json.RawMessage `json:"old,omitempty"`
+	New      json.RawMessage `json:"new,omitempty"`
+}
+
+//toJSON returns the serializable form of the alert
+func (a *Alert) toJSON() *JSONAlert {
+	ja := &JSONAlert{
+		Key:      a.Key,
+		Rule:     a.Rule,
+		URI:      a.URI,
+		Path:     a.Path,
+		Created:  a.Created.Format(jsLayout),
+		Snapshot: a.Snapshot,
+	}
+	if a.Old != "" {
+		ja.Old = json.RawMessage(a.Old)
+	}
+	if a.New != "" {
+		ja.New = json.RawMessage(a.New)
+	}
+	return ja
+}
+
+//snapshotChanged runs everything interested in cur being different from prev
+//prev is nil for the first snapshot of a resource
+//the snapshots are only decoded when someone is interested and then only once
+func snapshotChanged(ctx context.Context, prev, cur *Resource) {
+	if len(subscribersFor(cur.Type)) == 0 && (prev == nil || len(rulesFor(cur.URI)) == 0) {
+		return
+	}
+	old, doc, err := changedDocs(ctx, prev, cur)
+	if err != nil {
+		log.Printf("unable to decode snapshots of %s: %v", cur.URI, err)
+		return
+	}
+	notifyChange(ctx, prev, cur, old, doc)
+	watchChange(ctx, prev, cur, old, doc)
+}
+
+//rulesFor returns the watch rules matching uri
+func rulesFor(uri string) []*WatchRule {
+	var rules []*WatchRule
+	for i := range cfg.WatchRules {
+		if ok, _ := path.Match(cfg.WatchRules[i].Resource, uri); ok {
+			rules = append(rules, &cfg.WatchRules[i])
+		}
+	}
+	return rules
+}
+
+//watchChange raises the alerts of the watch rules matching the change from prev to cur
+//whose documents are old and doc, the first snapshot of a resource changes nothing so it raises none
+//failing to do so should not fail saving the snapshot so we only log errors
+func watchChange(ctx context.Context, prev, cur *Resource, old, doc interface{}) {
+	if prev == nil {
+		return
+	}
+	for _, rule := range rulesFor(cur.URI) {
+		a, err := rule.check(old, doc)
+		if err != nil {
+			log.Printf("ignoring watch rule %s: %v", rule.Name, err)
+			continue
+		}
+		if a == nil {
+			continue
+		}
+		a.URI = cur.URI
+		a.Snapshot = cur.Key
+		if _, err := alertLog.PutAlert(ctx, a); err != nil {
+			log.Printf("unable to store alert %#v: %v", a, err)
+			continue
+		}
+		log.Printf("watch rule %s matched %s", rule.Name, cur.URI)
+		for _, name := range rule.Notify {
+			alertLater(ctx, AlertArgs{Notifier: name, Alert: a.toJSON()})
+		}
+	}
+}
+
+//check returns the alert raised by the change from old to doc or nil when the rule does not match
+func (rule *WatchRule) check(old, doc interface{}) (*Alert, error) {
+	tokens, err := parseFieldPath(rule.Path)
+	if err != nil {
+		return nil, err
+	}
+	oldVal, oldFound := lookupPath(old, tokens)
+	newVal, newFound := lookupPath(doc, tokens)
+	oldJSON, err := fieldJSON(oldVal, oldFound)
+	if err != nil {
+		return nil, err
+	}
+	newJSON, err := fieldJSON(newVal, newFound)
+	if err != nil {
+		return nil, err
+	}
+	if oldJSON == newJSON {
+		return nil, nil
+	}
+	if rule.To != nil {
+		//numbers in the config and in snapshots decode differently so compare their JSON
+		to, err := fieldJSON(rule.To, true)
+		if err != nil {
+			return nil, err
+		}
+		if newJSON != to {
+			return nil, nil
+		}
+	}
+	return &Alert{
+		Rule:    rule.Name,
+		Path:    rule.Path,
+		Created: time.Now().UTC(),
+		Old:     oldJSON,
+		New:     newJSON,
+	}, nil
+}
+
+//fieldJSON returns the JSON encoding of a field value, empty when it is missing
+func fieldJSON(v interface{}, found bool) (string, error) {
+	if !found {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+//AlertArgs is an alert waiting to be delivered by the notifier named Notifier
+type AlertArgs struct {
+	Notifier string
+	Alert    *JSONAlert
+}
+
+func alertTask(ctx context.Context, body io.Reader) error {
+	var arg AlertArgs
+	if err := json.NewDecoder(body).Decode(&arg); err != nil {
+		log.Printf("trouble reading request body: %v", err)
+		return err
+	}
+	nc, ok := cfg.Notifiers[arg.Notifier]
+	if !ok {
+		log.Printf("abandon alert, no notifier %s", arg.Notifier)
+		return nil
+	}
+	kind, ok := notifierKinds[nc.Kind]
+	if !ok {
+		log.Printf("abandon alert, notifier %s has unknown kind %q", arg.Notifier, nc.Kind)
+		return nil
+	}
+	a := &Alert{
+		Key:      arg.Alert.Key,
+		Rule:     arg.Alert.Rule,
+		URI:      arg.Alert.URI,
+		Path:     arg.Alert.Path,
+		Snapshot: arg.Alert.Snapshot,
+		Old:      string(arg.Alert.Old),
+		New:      string(arg.Alert.New),
+	}
+	a.Created, _ = time.Parse(jsLayout, arg.Alert.Created)
+	if err := kind(nc).Notify(ctx, a); err != nil {
+		log.Printf("trouble notifying %s of alert %s: %v", arg.Notifier, a.Key, err)
+		return err
+	}
+	return nil
+}
+
+//webhookNotifier POSTs alerts as JSON to URL
+type webhookNotifier struct {
+	URL    string
+	Secret string
+}
+
+//Notify implements Notifier
+func (n *webhookNotifier) Notify(ctx context.Context, a *Alert) error {
+	body, err := json.Marshal(a.toJSON())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Secret != "" {
+		req.Header.Set("X-Res-Log-Signature", sign(n.Secret, body))
+	}
+	resp, err := notifyClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, n.URL)
+	}
+	return nil
+}
+
+//smtpNotifier mails alerts through the server at Addr
+type smtpNotifier struct {
+	Addr string
+	From string
+	To   []string
+}
+
+//Notify implements Notifier
+func (n *smtpNotifier) Notify(ctx context.Context, a *Alert) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [res-log] %s: %s changed\r\n", a.Rule, a.URI)
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s of %s changed on %s\r\n\r\n", a.Path, a.URI, a.Created.Format(jsLayout))
+	fmt.Fprintf(&msg, "old: %s\r\nnew: %s\r\nsnapshot: %s\r\n", a.Old, a.New, a.Snapshot)
+	return smtp.SendMail(n.Addr, nil, n.From, n.To, msg.Bytes())
+}
+
+//MaxAlertsPerPage is the most alerts alertsView returns at once
+const MaxAlertsPerPage = 500
+
+//alertsView answers /alerts with the alerts raised by watch rules newest first
+//filtered by the rule parameter and paged with limit and cursor
+func alertsView(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("content-type", "application/json")
+	q := AlertQuery{
+		Rule:   r.URL.Query().Get("rule"),
+		Cursor: r.URL.Query().Get("cursor"),
+		Limit:  50,
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > MaxAlertsPerPage {
+			http.Error(w, fmt.Sprintf("limit: expected a number between 1 and %d", MaxAlertsPerPage), http.StatusBadRequest)
+			return
+		}
+	}
+	alerts, next, err := alertLog.QueryAlerts(r.Context(), q)
+	if err != nil {
+		log.Printf("Failed to query alerts %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	list := make([]*JSONAlert, 0, len(alerts))
+	for _, a := range alerts {
+		list = append(list, a.toJSON())
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -20,7 +20,6 @@ import (
 	"text/template"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"google.golang.org/api/iterator"
 )
 
@@ -33,11 +32,25 @@ func getMux() *http.ServeMux {
 	mux.HandleFunc("/r/", receive)
 	mux.Handle("/l", http.NotFoundHandler())
 	mux.HandleFunc("/l/", resourcesView)
+	mux.HandleFunc("/d/", diffView)
+	mux.HandleFunc("/t/", timelineView)
+	mux.HandleFunc("/f/", fieldView)
+	mux.HandleFunc("/live", liveView)
 	mux.HandleFunc("/cron/daily", dailyView)
-	mux.Handle("/task/process_hook", authDecor(http.HandlerFunc(processHookView)))
-	mux.Handle("/task/save_resource", authDecor(http.HandlerFunc(saveResourceView)))
-	mux.Handle("/task/purge_before", authDecor(http.HandlerFunc(purgeBeforeView)))
-	mux.Handle("/task/purge_step", authDecor(http.HandlerFunc(purgeStepView)))
+	mux.HandleFunc("/cron/reconcile", reconcileCronView)
+	mux.Handle("/events", adminDecor(http.HandlerFunc(eventsView)))
+	mux.Handle("/events/", adminDecor(http.HandlerFunc(eventView)))
+	mux.Handle("/alerts", adminDecor(http.HandlerFunc(alertsView)))
+	mux.Handle("/admin/backfill", adminDecor(http.HandlerFunc(backfillView)))
+	mux.Handle("/admin/reconcile", adminDecor(http.HandlerFunc(reconcileView)))
+	mux.Handle("/admin/restore", adminDecor(http.HandlerFunc(restoreView)))
+	mux.Handle("/admin/keys", adminDecor(http.HandlerFunc(keysView)))
+	mux.Handle("/admin/keys/", adminDecor(http.HandlerFunc(keysView)))
+	mux.Handle("/admin/queue/dead", adminDecor(http.HandlerFunc(deadJobsView)))
+	mux.Handle("/admin/queue/dead/", adminDecor(http.HandlerFunc(deadJobsView)))
+	for path, fn := range taskFuncs {
+		mux.Handle(path, authDecor(taskView(fn)))
+	}
 	return mux
 }
 
@@ -55,43 +68,50 @@ func homeElm(w http.ResponseWriter, r *http.Request) {
 }
 
 func receive(w http.ResponseWriter, r *http.Request) {
-	err := processBody(r)
+	data, err := processBody(r)
 	if err != nil {
 		log.Printf("failed to process request with error: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	//let the sender retry the delivery rather than losing it
+	if err := processHookLater(r.Context(), data); err != nil {
+		http.Error(w, "unable to schedule processing", http.StatusServiceUnavailable)
+		return
+	}
 	w.Header().Add("X-Application-SHA256", AppKey256)
 	fmt.Fprintf(w, "OK")
 }
 
-func processBody(r *http.Request) error {
+//processBody reads and verifies the webhook batch returning it packed
+func processBody(r *http.Request) ([]byte, error) {
 	mac := hmac.New(sha256.New, []byte(cfg.AppKey)) //used later to verify signature
 
 	rdr, err := pack(io.TeeReader(io.LimitReader(r.Body, 8*1024*1024), mac)) //8MB arbitrary limit
 	if err != nil {
-		return err
+		return nil, err
 	}
 	data, err := ioutil.ReadAll(rdr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//now verify the HMAC
 	//decode message mac
 	messageMAC, err := hex.DecodeString(r.Header.Get("X-Gapi-Signature"))
+	expectedMAC := mac.Sum(nil)
+	valid := err == nil && hmac.Equal(messageMAC, expectedMAC)
+	//keep everything we receive even if we are not going to process it
+	logBatch(r, data, valid)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	expectedMAC := mac.Sum(nil)
-	if !hmac.Equal(messageMAC, expectedMAC) {
-		return fmt.Errorf("Unexpected X-Gapi-Signature received: %s", r.Header.Get("X-Gapi-Signature"))
+	if !valid {
+		return nil, fmt.Errorf("Unexpected X-Gapi-Signature received: %s", r.Header.Get("X-Gapi-Signature"))
 	}
 
 	//log.Printf("processed data long %d", len(data))
-	processHookLater(r.Context(), data)
-	return nil
+	return data, nil
 }
 
 type hookDataAttr struct {
@@ -106,6 +126,11 @@ type hookStruct struct {
 	Data      *hookDataAttr `json:"data"`
 }
 
+//isDeleted reports whether the hook announces the deletion of a resource
+func (h *hookStruct) isDeleted() bool {
+	return strings.HasSuffix(h.EventType, ".deleted")
+}
+
 func processHook(ctx context.Context, in io.Reader) error {
 	r, err := unpack(in)
 	if err != nil {
@@ -120,7 +145,14 @@ func processHook(ctx context.Context, in io.Reader) error {
 		return nil
 	}
 	for _, v := range events {
-		saveResourceLater(ctx, v)
+		if isIgnored(v.Resource) {
+			log.Printf("ignoring %s hook for %s", v.EventType, v.Resource)
+			continue
+		}
+		//retrying the whole batch is fine as unchanged snapshots are only marked as seen again
+		if err := saveResourceLater(ctx, v); err != nil {
+			return err
+		}
 		/*
 			task, err := saveResourceLater.Task(v)
 			if err != nil {
@@ -149,20 +181,61 @@ func processHook(ctx context.Context, in io.Reader) error {
 type Resource struct {
 	URI       string `datastore:"Uri"`
 	Type      string `datastore:"Type"`
+	EventType string `datastore:"EventType"`
 	HookDate  string `datastore:",noindex"`
 	Data      []byte `datastore:",noindex"`
 	FetchDate time.Time
 	Sha1      string `datastore:",noindex"`
+	//Ref is set on "seen again" markers saved when the fetched data did not change
+	//it is the key of the snapshot holding the data, indexed so the purge can project it
+	Ref string
+	//Deleted marks a tombstone saved when the resource was deleted
+	Deleted bool `datastore:",noindex"`
+	//Drift marks a snapshot saved by reconciliation because the resource changed without a webhook
+	Drift bool   `datastore:",noindex"`
+	Key   string `datastore:"-"`
 }
 
 //JSONResource is the same as Resource but more suitable for serializing
 type JSONResource struct {
+	Key       string          `json:"key,omitempty"`
 	FetchDate string          `json:"fetchdate"`
 	HookDate  string          `json:"hookdate"`
+	EventType string          `json:"event_type,omitempty"`
 	Sha1      string          `json:"sha1"`
+	Unchanged bool            `json:"unchanged,omitempty"`
+	Deleted   bool            `json:"deleted,omitempty"`
+	Drift     bool            `json:"drift,omitempty"`
+	URI       string          `json:"uri,omitempty"`
 	Data      json.RawMessage `json:"resource"`
 }
 
+//SnapshotMeta describes a snapshot without its data
+type SnapshotMeta struct {
+	Key       string `json:"key"`
+	FetchDate string `json:"fetchdate"`
+	HookDate  string `json:"hookdate"`
+	EventType string `json:"event_type,omitempty"`
+	Sha1      string `json:"sha1"`
+	Unchanged bool   `json:"unchanged,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Drift     bool   `json:"drift,omitempty"`
+}
+
+//Meta returns the metadata of this resource
+func (r *Resource) Meta() SnapshotMeta {
+	return SnapshotMeta{
+		Key:       r.Key,
+		FetchDate: r.FetchDate.Format(jsLayout),
+		HookDate:  r.HookDate,
+		EventType: r.EventType,
+		Sha1:      r.Sha1,
+		Unchanged: r.Ref != "",
+		Deleted:   r.Deleted,
+		Drift:     r.Drift,
+	}
+}
+
 //jsLayout is for formatting dates
 const jsLayout = "2006-01-02T15:04:05Z"
 
@@ -193,26 +266,91 @@ func NewCountingWriter(out io.Writer) *CountingWriter {
 
 //WriteAsJSON writes this resource to Writer as JSON
 func (r *Resource) WriteAsJSON(out io.Writer) (int, error) {
-	jsr := JSONResource{
-		FetchDate: r.FetchDate.Format(jsLayout),
-		HookDate:  r.HookDate,
-		Sha1:      r.Sha1,
+	jsr, err := r.fullJSONResource()
+	if err != nil {
+		return 0, err
 	}
+	outbuf := NewCountingWriter(out)
+	err = json.NewEncoder(outbuf).Encode(&jsr)
+	return outbuf.Written, err
+}
+
+//fullJSONResource returns the JSONResource for this resource with its data unpacked
+func (r *Resource) fullJSONResource() (JSONResource, error) {
+	jsr := r.jsonResource()
 	if len(r.Data) > 0 {
 		dr, err := gzip.NewReader(bytes.NewBuffer(r.Data))
 		if err != nil {
-			return 0, err
+			return jsr, err
 		}
 		jsr.Data, err = ioutil.ReadAll(dr)
 		if err != nil {
-			return 0, err
+			return jsr, err
 		}
 		if err := dr.Close(); err != nil {
-			return 0, err
+			return jsr, err
 		}
 	}
+	return jsr, nil
+}
+
+//gzipResourceField and gzipEnvelopeEnd surround the stored data in WriteAsGzipJSON
+var (
+	gzipResourceField = []byte(`,"resource":`)
+	gzipEnvelopeEnd   = []byte("}\n")
+)
+
+//WriteAsGzipJSON writes this resource to Writer as gzip compressed JSON
+//the stored data is already gzipped so it is passed through as is between
+//gzip members holding the metadata and the end of the JSON envelope
+func (r *Resource) WriteAsGzipJSON(out io.Writer) (int, error) {
+	meta, err := json.Marshal(r.Meta())
+	if err != nil {
+		return 0, err
+	}
+	//leave the metadata object open so the data follows as its last field
+	if len(meta) < 2 || meta[len(meta)-1] != '}' {
+		return 0, fmt.Errorf("unexpected snapshot metadata %s", meta)
+	}
+	prefix := append(meta[:len(meta)-1:len(meta)-1], gzipResourceField...)
 	outbuf := NewCountingWriter(out)
-	err := json.NewEncoder(outbuf).Encode(&jsr)
+	if err := writeGzipMember(outbuf, prefix); err != nil {
+		return outbuf.Written, err
+	}
+	if _, err := outbuf.Write(r.Data); err != nil {
+		return outbuf.Written, err
+	}
+	err = writeGzipMember(outbuf, gzipEnvelopeEnd)
+	return outbuf.Written, err
+}
+
+func writeGzipMember(out io.Writer, data []byte) error {
+	gzw := gzip.NewWriter(out)
+	if _, err := gzw.Write(data); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+//jsonResource returns the JSONResource for this resource without its data
+func (r *Resource) jsonResource() JSONResource {
+	return JSONResource{
+		Key:       r.Key,
+		FetchDate: r.FetchDate.Format(jsLayout),
+		HookDate:  r.HookDate,
+		EventType: r.EventType,
+		Sha1:      r.Sha1,
+		Unchanged: r.Ref != "",
+		Deleted:   r.Deleted,
+		Drift:     r.Drift,
+	}
+}
+
+//WriteMetaAsJSON writes the metadata of this resource to Writer as JSON
+func (r *Resource) WriteMetaAsJSON(out io.Writer) (int, error) {
+	meta := r.Meta()
+	outbuf := NewCountingWriter(out)
+	err := json.NewEncoder(outbuf).Encode(&meta)
 	return outbuf.Written, err
 }
 
@@ -239,21 +377,71 @@ func saveResource(c context.Context, hook *hookStruct) error {
 	default:
 		return fmt.Errorf("Unexpected type for Hook.Data.ID: %T", t)
 	}
+	if hook.isDeleted() {
+		//there is nothing left to fetch
+		return saveTombstone(c, hook, uriBuf.String())
+	}
 	//fetch the resource
-	client := http.DefaultClient
-	req, err := http.NewRequest("GET", hook.Data.Href, nil)
-	if err != nil {
-		log.Printf("failed to build GET request for: %s", hook.Data.Href)
+	pdata, sum, err := fetchData(c, hook.Data.Href)
+	if err == errUnusable {
+		return nil
+	} else if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("X-Application-Key", cfg.AppKey)
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("failed to fetch: %s", hook.Data.Href)
+	//create and save
+	r := Resource{
+		URI:       uriBuf.String(),
+		Type:      hook.Resource,
+		EventType: hook.EventType,
+		HookDate:  hook.Created,
+		Data:      pdata,
+		FetchDate: time.Now().UTC(),
+		Sha1:      sum}
+
+	//when nothing changed since the last snapshot only record that we have seen it again
+	last, err := latestForURI(c, r.URI)
+	if err != nil && err != errNotFound {
+		log.Printf("unable to query latest snapshot of %s", r.URI)
+		return err
+	}
+	if last != nil && last.Sha1 == r.Sha1 {
+		r.Data = nil
+		r.Ref = last.Ref
+		if r.Ref == "" {
+			r.Ref = last.Key
+		}
+	}
+
+	if _, err := store.Put(c, &r); err != nil {
+		log.Printf("unable to store resource %#v", r)
 		return err
 	}
+	feed.publish(&r)
+	if r.Ref == "" {
+		snapshotChanged(c, last, &r)
+	}
+	return nil
+}
+
+//errUnusable is returned by fetchData when the fetched resource can not be stored
+var errUnusable = fmt.Errorf("unusable resource data")
+
+//fetchData fetches url returning its packed body and the SHA1 of the original
+func fetchData(ctx context.Context, url string) ([]byte, string, error) {
+	resp, err := apiGet(ctx, url)
+	if err != nil {
+		return nil, "", err
+	}
 	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		//the API is busy or having trouble so the task should try again later
+		return nil, "", fmt.Errorf("unexpected status %d for %s", resp.StatusCode, url)
+	default:
+		log.Printf("unexpected status %d so abandon %s", resp.StatusCode, url)
+		return nil, "", errUnusable
+	}
 
 	//first reader json verif
 	origBuf := new(bytes.Buffer)
@@ -264,20 +452,20 @@ func saveResource(c context.Context, hook *hookStruct) error {
 	//pack the response returns a final reader
 	pr, err := pack(shar)
 	if err != nil {
-		log.Printf("failed to pack: %s", hook.Data.Href)
-		return err
+		log.Printf("failed to pack: %s", url)
+		return nil, "", err
 	}
 	pdata, err := ioutil.ReadAll(pr)
 	if err != nil {
-		log.Printf("failed to read packed: %s", hook.Data.Href)
-		return err
+		log.Printf("failed to read packed: %s", url)
+		return nil, "", err
 	}
 	if len(pdata) > MaxDataStoreByteSize {
 		log.Printf(
 			"compressed resource is too large %d abandon: %s",
 			len(pdata),
-			hook.Data.Href)
-		return nil
+			url)
+		return nil, "", errUnusable
 	}
 	//now verify that this is ok json
 	var someJSON map[string]interface{}
@@ -285,29 +473,94 @@ func saveResource(c context.Context, hook *hookStruct) error {
 	if derr := dec.Decode(&someJSON); derr != nil {
 		log.Printf(
 			"failed to properly decode json so abandon %s: %v",
-			hook.Data.Href, derr)
-		return nil
+			url, derr)
+		return nil, "", errUnusable
 	}
-	//create and save
+	return pdata, hex.EncodeToString(shaw.Sum(nil)), nil
+}
+
+//apiGet fetches url from the REST API using our application key
+func apiGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		log.Printf("failed to build GET request for: %s", url)
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Application-Key", cfg.AppKey)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		log.Printf("failed to fetch: %s", url)
+		return nil, err
+	}
+	return resp, nil
+}
+
+//saveTombstone records the deletion of a resource in its history
+func saveTombstone(c context.Context, hook *hookStruct, uri string) error {
 	r := Resource{
-		URI:       uriBuf.String(),
+		URI:       uri,
 		Type:      hook.Resource,
+		EventType: hook.EventType,
 		HookDate:  hook.Created,
-		Data:      pdata,
 		FetchDate: time.Now().UTC(),
-		Sha1:      hex.EncodeToString(shaw.Sum(nil))}
-
-	dsClient, err := datastore.NewClient(c, projectID)
-	if err != nil {
-		log.Printf("unable to create Datastore client %v", err)
+		Deleted:   true,
+	}
+	if _, err := store.Put(c, &r); err != nil {
+		log.Printf("unable to store tombstone %#v", r)
 		return err
 	}
+	feed.publish(&r)
+	return nil
+}
 
-	_, err = dsClient.Put(c, datastore.IncompleteKey("resource", nil), &r)
+//latestForURI returns the most recent snapshot of uri
+func latestForURI(ctx context.Context, uri string) (*Resource, error) {
+	var res Resource
+	err := store.Query(ctx, ResourceQuery{URI: uri}).Next(&res)
+	if err == iterator.Done {
+		return nil, errNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+//snapshotByKey returns the snapshot saved under key with its data resolved
+//as long as it belongs to uri
+func snapshotByKey(ctx context.Context, uri, key string) (*Resource, error) {
+	res, err := store.Get(ctx, key)
 	if err != nil {
-		log.Printf("unable to store resource %#v", r)
-		return err
+		return nil, err
+	}
+	if res.URI != uri {
+		return nil, errNotFound
+	}
+	if err := resolveData(ctx, res, make(map[string][]byte)); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//resolveData fills in the data of a "seen again" marker from the snapshot it refers to
+//cache holds the data of snapshots already loaded by the caller
+func resolveData(ctx context.Context, res *Resource, cache map[string][]byte) error {
+	if res.Ref == "" {
+		return nil
+	}
+	data, ok := cache[res.Ref]
+	if !ok {
+		ref, err := store.Get(ctx, res.Ref)
+		if err == errNotFound {
+			//the snapshot has been purged already
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data = ref.Data
+		cache[res.Ref] = data
 	}
+	res.Data = data
 	return nil
 }
 
@@ -326,29 +579,93 @@ func getURLPart(prefix, urlpath string, idx int) (r string) {
 	return
 }
 
+//defaultPrivateTypes are private when PrivateTypes is not configured
+var defaultPrivateTypes = []string{"documents", "refunds", "payments", "agents"}
+
+//isPrivate reports whether res may only be read with an API key
 func isPrivate(res string) bool {
-	private := []string{"documents", "refunds", "payments", "agents"}
+	private := cfg.PrivateTypes
+	if private == nil {
+		private = defaultPrivateTypes
+	}
+	return typeIn(private, res)
+}
+
+//isIgnored reports whether hooks for res are dropped without fetching the resource
+func isIgnored(res string) bool {
+	if len(cfg.AllowedTypes) > 0 && !typeIn(cfg.AllowedTypes, res) {
+		return true
+	}
+	return typeIn(cfg.IgnoredTypes, res)
+}
+
+//uriType returns the resource type of uri which is the part before the id
+func uriType(uri string) string {
+	return strings.SplitN(uri, "/", 2)[0]
+}
+
+//typeIn reports whether the resource type res is in list
+func typeIn(list []string, res string) bool {
 	r := strings.ToLower(strings.TrimSpace(res))
-	for _, v := range private {
-		if r == v {
+	for _, v := range list {
+		if r == strings.ToLower(strings.TrimSpace(v)) {
 			return true
 		}
 	}
 	return false
 }
 
-//MaxRespSize is maximum response size we are willing to return
+//resourceURIFromPath returns the type/id URI addressed by a path under prefix
+//it writes an error response and returns false when the resource is missing or not readable by the caller
+func resourceURIFromPath(w http.ResponseWriter, r *http.Request, prefix string) (string, bool) {
+	restype := getURLPart(prefix, r.URL.Path, 0)
+	resid := getURLPart(prefix, r.URL.Path, 1)
+	if restype == "" || resid == "" {
+		http.Error(w, "missing resource type or ID", http.StatusBadRequest)
+		return "", false
+	}
+	if !authorizeType(w, r, restype) {
+		return "", false
+	}
+	return restype + "/" + resid, true
+}
+
+//DefaultPageSize is how many snapshots the /l/ listing returns when no limit is given
+const DefaultPageSize = 100
+
+//MaxPageBytes is how much of a /l/ listing page we buffer before cutting it short
+//the page is buffered so the next cursor can go in the headers, the rest follows with that cursor
+const MaxPageBytes = 4 * 1024 * 1024
+
+//MaxRespSize is maximum response size we are willing to return when the /l/ listing is not paged
 const MaxRespSize = 30 * 1024 * 1024 //30MB arbitrary arrived at via 500 errors
 
-func resourcesView(w http.ResponseWriter, r *http.Request) {
-	//enable the CORS preflight wonder used by browsers
+//adminDecor only lets through requests carrying the configured AdminKey in the X-Admin-Key header
+//admin endpoints are disabled when no AdminKey is configured
+func adminDecor(next http.Handler) http.Handler {
+	closure := func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Admin-Key")
+		if cfg.AdminKey == "" || !hmac.Equal([]byte(key), []byte(cfg.AdminKey)) {
+			http.Error(w, "Not Authorized", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(closure)
+}
+
+//allowCORS enables the CORS preflight wonder used by browsers
+func allowCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	w.Header().Add("Access-Control-Allow-Methods", "POST, GET, OPTIONS, HEAD")
 	for _, value := range r.Header["Access-Control-Request-Headers"] {
 		w.Header().Add("Access-Control-Allow-Headers", value)
 	}
 	w.Header().Add("Access-Control-Max-Age", "3600")
-	//end of CORS
+}
+
+func resourcesView(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r)
 	//response content type header
 	w.Header().Add("content-type", "application/json")
 
@@ -359,21 +676,14 @@ func resourcesView(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing resource type or ID", http.StatusBadRequest)
 		return
 	}
-	if isPrivate(restype) {
-		http.Error(w, "Not Authorized", http.StatusForbidden)
+	if !authorizeType(w, r, restype) {
 		return
 	}
 	c := r.Context()
-	dsClient, err := datastore.NewClient(c, projectID)
-	if err != nil {
-		log.Printf("Failed to create a datastore client %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
 	if resid == "" {
 		//no ID passed get the most recent id
-		resid, err = getRecentIDForResource(c, dsClient, restype)
+		var err error
+		resid, err = getRecentIDForResource(c, restype)
 		if err != nil {
 			log.Printf("Failed to query most recent ID for resource %s %v", restype, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -383,123 +693,197 @@ func resourcesView(w http.ResponseWriter, r *http.Request) {
 	str := bytes.NewBufferString(restype)
 	str.WriteString("/")
 	str.WriteString(resid)
-	q := datastore.NewQuery("resource").Filter("Uri =", str.String()).Order("-FetchDate")
-	//iterate query and write it to response up to a limit
+	if r.URL.Query().Get("at") != "" || r.URL.Query().Get("key") != "" {
+		snapshotView(w, r, str.String())
+		return
+	}
+	metaOnly := r.URL.Query().Get("fields") == "meta"
+	q, err := listingQuery(r, str.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//iterate query and buffer a page up to a limit so that the next cursor can go in the headers
+	//without a limit or cursor it is all written to the response up to MaxRespSize
 	var (
 		totalBytes int64
-		isFirst    = true
+		maxBytes   int64 = MaxPageBytes
+		count      int
+		next       string
+		refs       = make(map[string][]byte)
+		page       = new(bytes.Buffer)
+		out        = bufio.NewWriter(page)
 	)
-	t := dsClient.Run(c, q)
-	out := bufio.NewWriter(w)
+	paged := q.Limit > 0
+	if !paged {
+		out = bufio.NewWriter(w)
+		maxBytes = MaxRespSize
+	}
+	t := store.Query(c, q)
 	out.WriteString("[")
 	for {
 		var res Resource
-		_, err := t.Next(&res)
+		err := t.Next(&res)
 		if err == iterator.Done {
+			next = ""
 			break
+		} else if err == errBadCursor {
+			http.Error(w, "cursor: "+err.Error(), http.StatusBadRequest)
+			return
 		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if !isFirst {
+		if (paged && count == q.Limit) || totalBytes >= maxBytes {
+			//there is more than we are willing to return
+			break
+		}
+		if count > 0 {
 			out.WriteString(",")
-		} else {
-			isFirst = false
 		}
-		size, err := res.WriteAsJSON(out)
+		var size int
+		if metaOnly {
+			size, err = res.WriteMetaAsJSON(out)
+		} else if err = resolveData(c, &res, refs); err == nil {
+			size, err = res.WriteAsJSON(out)
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		totalBytes = totalBytes + int64(size)
-		if totalBytes >= MaxRespSize {
-			break
+		count++
+		if !paged {
+			continue
+		}
+		if next, err = t.Cursor(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 	}
 	out.WriteString("]")
 	out.Flush()
+	if !paged {
+		return
+	}
+	w.Header().Add("Access-Control-Expose-Headers", "X-Next-Cursor")
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	page.WriteTo(w)
 }
 
-//PurgeInput represents the data struct for purge operation
-type PurgeInput struct {
-	Before string
+//listingQuery builds the query for the /l/ listing of uri from the
+//limit, since, until, event_type and cursor parameters, limit defaults to DefaultPageSize
+//when a cursor is given and to no limit at all when neither is
+func listingQuery(r *http.Request, uri string) (ResourceQuery, error) {
+	var err error
+	q := ResourceQuery{URI: uri, Cursor: r.URL.Query().Get("cursor")}
+	if q.Cursor != "" {
+		q.Limit = DefaultPageSize
+	}
+	if q.EventType = r.URL.Query().Get("event_type"); q.EventType != "" && !strings.Contains(q.EventType, ".") {
+		//short form like updated
+		q.EventType = uriType(uri) + "." + q.EventType
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("limit: expected a positive number got %q", v)
+		}
+	}
+	if q.Since, err = parseTimeParam(r, "since", time.Time{}); err != nil {
+		return q, fmt.Errorf("since: %v", err)
+	}
+	if q.Until, err = parseTimeParam(r, "until", time.Time{}); err != nil {
+		return q, fmt.Errorf("until: %v", err)
+	}
+	return q, nil
 }
 
-func purgeBefore(ctx context.Context, when time.Time, encCursor string) (err error) {
+//snapshotView writes a single snapshot of uri, the one saved under the key parameter
+//or the one in effect at the time given by the at parameter
+func snapshotView(w http.ResponseWriter, r *http.Request, uri string) {
 	var (
-		stop      bool
-		keys      []*datastore.Key
-		newCursor string
+		res *Resource
+		err error
 	)
-	q := datastore.NewQuery("resource").Filter("FetchDate <", when).KeysOnly()
-	if encCursor != "" {
-		cursor, err := datastore.DecodeCursor(encCursor)
-		if err == nil {
-			q = q.Start(cursor)
+	if key := r.URL.Query().Get("key"); key != "" {
+		res, err = snapshotByKey(r.Context(), uri, key)
+		if err == errNotFound {
+			http.Error(w, "no snapshot "+key, http.StatusNotFound)
+			return
 		}
 	} else {
-		log.Printf("Starting purge of anything older than %v", when)
+		var at time.Time
+		if at, err = parseTimeParam(r, "at", time.Time{}); err != nil {
+			http.Error(w, "at: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err = snapshotAt(r.Context(), uri, at)
+		if err == errNotFound {
+			http.Error(w, "no snapshot at "+at.Format(jsLayout), http.StatusNotFound)
+			return
+		}
 	}
-
-	// Iterate over the results.
-	dsClient, err := datastore.NewClient(ctx, projectID)
 	if err != nil {
-		log.Printf("unable to create Datastore client %v", err)
+		log.Printf("Failed to query snapshot of %s: %v", uri, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	out := bufio.NewWriter(w)
+	if len(res.Data) > 0 && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		_, err = res.WriteAsGzipJSON(out)
+	} else {
+		_, err = res.WriteAsJSON(out)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out.Flush()
+}
 
-	t := dsClient.Run(ctx, q)
-	for i := 0; i < 100; i++ {
-		key, err := t.Next(nil)
-		if err == iterator.Done {
-			stop = true
-			break
+//acceptsGzip reports whether the client accepts gzip content encoding
+//a q value of 0 refuses it
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
 		}
-		if err != nil {
-			log.Printf("fetching next Key: %v", err)
-			return err
+		for _, param := range parts[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+				return err == nil && q > 0
+			}
 		}
-		//do something with it
-		keys = append(keys, key)
-	}
-
-	// Get updated cursor and store it for next time.
-	if cursor, err := t.Cursor(); err == nil {
-		newCursor = cursor.String()
+		return true
 	}
+	return false
+}
 
-	err = dsClient.DeleteMulti(ctx, keys)
-	if err != nil {
-		log.Printf("trouble with multi delete: %v", err)
-		return err
-	}
-	if !stop {
-		purgeStepLater(ctx, when, newCursor)
-	}
-	return nil
+//PurgeInput represents the data struct for purge operation
+type PurgeInput struct {
+	Before string
 }
 
-func getRecentIDForResource(ctx context.Context, client *datastore.Client, resource string) (string, error) {
-	q := datastore.NewQuery("resource").
-		Filter("Type =", resource).
-		Order("-FetchDate").
-		Limit(1)
-	var resources []Resource
-	keys, err := client.GetAll(ctx, q, &resources)
-	if err != nil {
-		return "", err
-	}
-	if len(keys) == 0 {
+func getRecentIDForResource(ctx context.Context, resource string) (string, error) {
+	res, err := store.LatestByType(ctx, resource)
+	if err == errNotFound {
 		return "", fmt.Errorf("Query for recent ID had no results")
+	} else if err != nil {
+		return "", err
 	}
-	return strings.Replace(resources[0].URI, resource+"/", "", 1), nil
+	return strings.Replace(res.URI, resource+"/", "", 1), nil
 }
 
 func dailyView(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	ctx := r.Context()
-	t := time.Now().UTC().Add(-31 * 24 * time.Hour)
-	purgeBeforeLater(ctx, t)
+	purgeLater(ctx, time.Now().UTC())
 	w.Header().Add("content-type", "application/json")
 	fmt.Fprintf(w, "\"OK\"")
 }